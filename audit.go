@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// auditentry is single line of audit log.
+type auditentry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Raddr  string    `json:"raddr"`
+	Action string    `json:"action"`
+	Port   string    `json:"port,omitempty"`
+	Before *port     `json:"before,omitempty"`
+	After  *port     `json:"after,omitempty"`
+	// Diff has old and new value of every changed config field.
+	Diff   map[string][2]interface{} `json:"diff,omitempty"`
+	Result string                    `json:"result"`
+}
+
+// auditfile is name of audit log in logs dir.
+const auditfile = "audit.jsonl"
+
+// auditlog is append only JSON lines file, rotated with maxsize, maxbackups
+// and maxage of logs config like other logs.
+var auditlog = struct {
+	mu   sync.Mutex
+	l    *lumberjack.Logger
+	name string
+}{}
+
+// openaudit will open audit log in given logs dir as per logs config.
+func openaudit(dir string) error {
+	name := dir + auditfile
+	// File is created here so that unwritable logs dir fails at once, new
+	// files of rotation keep its mode.
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	config.mu.Lock()
+	l := &lumberjack.Logger{Filename: name, MaxSize: config.Logs.Maxsize,
+		MaxBackups: config.Logs.Maxbackups, MaxAge: config.Logs.Maxage}
+	config.mu.Unlock()
+	auditlog.mu.Lock()
+	defer auditlog.mu.Unlock()
+	auditlog.l = l
+	auditlog.name = name
+	return nil
+}
+
+// closeaudit will close audit log.
+func closeaudit() {
+	auditlog.mu.Lock()
+	defer auditlog.mu.Unlock()
+	if auditlog.l == nil {
+		return
+	}
+	auditlog.l.Close()
+	auditlog.l = nil
+}
+
+// audit will append entry to audit log, errors are only logged as
+// audit must not fail user action.
+func audit(e auditentry) {
+	e.Time = time.Now().UTC()
+	if e.Before != nil || e.After != nil {
+		e.Diff = portdiff(e.Before, e.After)
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Error in audit JSON Marshal: %s", err)
+		return
+	}
+	auditlog.mu.Lock()
+	defer auditlog.mu.Unlock()
+	if auditlog.l == nil {
+		return
+	}
+	if _, err = auditlog.l.Write(append(b, '\n')); err != nil {
+		log.Printf("Error writing audit log: %s", err)
+	}
+}
+
+// auditsession will record start or end of console session.
+func auditsession(s *session, pname string, action string) {
+	audit(auditentry{Actor: s.user, Raddr: s.raddr, Action: action + "." + s.kind,
+		Port: pname, Result: "ok"})
+}
+
+// portdiff will return changed fields between two port configs, missing
+// config is treated as empty one.
+func portdiff(before *port, after *port) map[string][2]interface{} {
+	oldfields := portfields(before)
+	newfields := portfields(after)
+	diff := make(map[string][2]interface{})
+	for k, v := range oldfields {
+		if n, got := newfields[k]; !got || !reflect.DeepEqual(n, v) {
+			diff[k] = [2]interface{}{v, newfields[k]}
+		}
+	}
+	for k, n := range newfields {
+		if _, got := oldfields[k]; !got {
+			diff[k] = [2]interface{}{nil, n}
+		}
+	}
+	return diff
+}
+
+// portfields will return port config as flat field map.
+func portfields(pc *port) map[string]interface{} {
+	m := make(map[string]interface{})
+	if pc == nil {
+		return m
+	}
+	b, _ := json.Marshal(pc)
+	json.Unmarshal(b, &m)
+	return m
+}
+
+// auditrecorder will keep status and error message written by handler.
+type auditrecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (a *auditrecorder) WriteHeader(status int) {
+	a.status = status
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *auditrecorder) Write(b []byte) (int, error) {
+	if a.status >= http.StatusBadRequest && a.body.Len() < 512 {
+		a.body.Write(b)
+	}
+	return a.ResponseWriter.Write(b)
+}
+
+// withaudit will record given mutating API call with config of port before
+// and after call. Port is taken from portname query and newname of body.
+func withaudit(action string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pname := r.URL.Query().Get("portname")
+		var jport jsonport
+		if r.Body != nil {
+			b, _ := ioutil.ReadAll(r.Body)
+			r.Body = ioutil.NopCloser(bytes.NewReader(b))
+			json.Unmarshal(b, &jport)
+		}
+		newname := pname
+		if jport.Newname != "" {
+			newname = jport.Newname
+		}
+		e := auditentry{Actor: username(r), Raddr: r.RemoteAddr, Action: action, Port: pname}
+		if e.Port == "" {
+			e.Port = newname
+		}
+		if pc, err := config.getElement(pname); err == nil && pname != "" {
+			e.Before = &pc
+		}
+		rec := &auditrecorder{ResponseWriter: w, status: http.StatusOK}
+		// Handler may panic, record it anyway.
+		defer func() {
+			if pc, err := config.getElement(newname); err == nil && newname != "" {
+				e.After = &pc
+			}
+			e.Result = "ok"
+			if rec.status >= http.StatusBadRequest {
+				e.Result = "error: " + strconv.Itoa(rec.status) + " " + rec.body.String()
+			}
+			audit(e)
+		}()
+		next(rec, r)
+	}
+}
+
+// getAudit will return audit entries as JSON array filtered by since and
+// until (RFC 3339), port and actor. Only entries of ports on which user has
+// admin role are returned, limit keeps newest entries. Only current file is
+// read, its size is bounded by logs maxsize, rotated files are served under
+// /logs/ to admins.
+func getAudit(w http.ResponseWriter, r *http.Request) {
+	var since, until time.Time
+	var err error
+	if v := r.FormValue("since"); v != "" {
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid since time, use RFC 3339 format."))
+			return
+		}
+	}
+	if v := r.FormValue("until"); v != "" {
+		if until, err = time.Parse(time.RFC3339, v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid until time, use RFC 3339 format."))
+			return
+		}
+	}
+	limit := 1000
+	if v := r.FormValue("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid limit."))
+			return
+		}
+	}
+	pname := r.FormValue("port")
+	actor := r.FormValue("actor")
+
+	auditlog.mu.Lock()
+	name := auditlog.name
+	auditlog.mu.Unlock()
+	f, err := os.Open(name)
+	if err != nil {
+		log.Printf("[Client:%s]Error opening audit log: %s", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error reading audit log."))
+		return
+	}
+	defer f.Close()
+	entries := []json.RawMessage{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var e auditentry
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			continue
+		}
+		if (!since.IsZero() && e.Time.Before(since)) || (!until.IsZero() && e.Time.After(until)) ||
+			(pname != "" && e.Port != pname) || (actor != "" && e.Actor != actor) {
+			continue
+		}
+		p := e.Port
+		if p == "" {
+			p = "*"
+		}
+		if portrole(r, p) < roleAdmin {
+			continue
+		}
+		entries = append(entries, json.RawMessage(append([]byte(nil), scanner.Bytes()...)))
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	dir := t.TempDir() + "/"
+	if err := openaudit(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer closeaudit()
+	if fi, err := os.Stat(dir + auditfile); err != nil || fi.Mode().Perm() != 0640 {
+		t.Fatalf("audit log not created with mode 0640: %v", err)
+	}
+	before := &port{Name: "/dev/ttyUSB0", Desc: "lab"}
+	after := &port{Name: "/dev/ttyUSB0", Desc: "core switch"}
+	audit(auditentry{Actor: "alice", Action: "port.edit", Port: "/dev/ttyUSB0", Before: before, After: after, Result: "ok"})
+	audit(auditentry{Actor: "bob", Action: "port.stop", Port: "/dev/ttyUSB1", Result: "ok"})
+
+	w := httptest.NewRecorder()
+	getAudit(w, httptest.NewRequest("GET", "/audit?actor=alice", nil))
+	var entries []auditentry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("audit = %s: %v", w.Body, err)
+	}
+	if len(entries) != 1 || entries[0].Action != "port.edit" {
+		t.Fatalf("entries of alice = %+v", entries)
+	}
+	if d := entries[0].Diff["Desc"]; d[0] != "lab" || d[1] != "core switch" {
+		t.Errorf("diff of Desc = %v", d)
+	}
+
+	// Closed log drops entries, it does not fail caller.
+	closeaudit()
+	audit(auditentry{Actor: "carol", Action: "port.start", Result: "ok"})
+}
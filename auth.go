@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// roles in increasing order of access. viewer can watch console and logs,
+// operator can also write to console and start/stop port, admin can also
+// add, edit and delete port.
+const (
+	roleNone = iota
+	roleViewer
+	roleOperator
+	roleAdmin
+)
+
+var rolenames = map[string]int{
+	"viewer":   roleViewer,
+	"operator": roleOperator,
+	"admin":    roleAdmin,
+}
+
+// authconfig struct as per yaml config
+type authconfig struct {
+	Enable int `yaml:"enable"`
+	Users  []struct {
+		Name string `yaml:"name"`
+		// Password is bcrypt hash of password, see -hash-password flag.
+		Password string `yaml:"password"`
+		// Roles maps port name or * for all ports to role.
+		Roles map[string]string `yaml:"roles"`
+	} `yaml:"users"`
+	Tokens []struct {
+		Name string `yaml:"name"`
+		// User whose roles are given to token.
+		User string `yaml:"user"`
+		// Sha256 is hex encoded sha256 of bearer token.
+		Sha256 string `yaml:"sha256"`
+	} `yaml:"tokens"`
+	// Origins are origins like https://console.example.com of pages allowed
+	// to use API and websocket besides server itself, e.g. behind proxy.
+	Origins []string `yaml:"origins,omitempty"`
+}
+
+// authuser is authenticated user of request.
+type authuser struct {
+	name  string
+	roles map[string]string
+}
+
+type authkey int
+
+const userkey authkey = 0
+
+// cookie set after successful login so websocket upgrade and later
+// requests of browser are authenticated without password check.
+const (
+	sessioncookie = "spw_session"
+	sessionttl    = 12 * time.Hour
+)
+
+var (
+	// cookiekey signs session cookies, new key on every start.
+	cookiekey = make([]byte, 32)
+	// verified caches successful bcrypt checks as bcrypt is slow by design,
+	// with expiry time of every check.
+	verified = struct {
+		mu sync.Mutex
+		m  map[string]time.Time
+	}{m: make(map[string]time.Time)}
+)
+
+// cached bcrypt check is valid for verifiedttl, at most maxverified checks
+// are kept.
+const (
+	verifiedttl = 10 * time.Minute
+	maxverified = 1024
+)
+
+func init() {
+	if _, err := rand.Read(cookiekey); err != nil {
+		log.Fatalf("Error generating cookie key: %s", err)
+	}
+}
+
+// authenabled will return true if authentication is enabled in config.
+func authenabled() bool {
+	config.mu.Lock()
+	defer config.mu.Unlock()
+	return config.Auth.Enable == 1
+}
+
+// check will add problems of users, roles and tokens of auth config to errs.
+func (a *authconfig) check(errs *configerrors) {
+	if a.Enable != 0 && a.Enable != 1 && a.Enable != 2 {
+		errs.add("auth.enable", "must be 1 (enabled) or 2 (disabled)")
+	}
+	for index, o := range a.Origins {
+		if u, err := url.Parse(o); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			errs.add(fmt.Sprintf("auth.origins[%d]", index), "must be scheme and host like https://console.example.com")
+		}
+	}
+	if a.Enable != 1 {
+		return
+	}
+	users := make(map[string]bool)
+	for index, u := range a.Users {
+		path := fmt.Sprintf("auth.users[%d]", index)
+		if u.Name == "" {
+			errs.add(path+".name", "must not be empty")
+		} else if users[u.Name] {
+			errs.add(path+".name", "duplicate user %s", u.Name)
+		}
+		if _, err := bcrypt.Cost([]byte(u.Password)); err != nil {
+			errs.add(path+".password", "is not bcrypt hash, see -hash-password")
+		}
+		for p, role := range u.Roles {
+			if _, got := rolenames[role]; !got {
+				errs.add(path+".roles."+p, "unknown role %s", role)
+			}
+		}
+		users[u.Name] = true
+	}
+	for index, t := range a.Tokens {
+		path := fmt.Sprintf("auth.tokens[%d]", index)
+		if !users[t.User] {
+			errs.add(path+".user", "unknown user %s", t.User)
+		}
+		if b, err := hex.DecodeString(t.Sha256); err != nil || len(b) != sha256.Size {
+			errs.add(path+".sha256", "must be hex encoded sha256")
+		}
+	}
+}
+
+// authenticate will return user of request from session cookie, bearer
+// token or basic auth, or nil if none matches. basic tells that password
+// was checked, so that browser can be given session cookie.
+func authenticate(r *http.Request) (u *authuser, basic bool) {
+	config.mu.Lock()
+	a := config.Auth
+	config.mu.Unlock()
+	if c, err := r.Cookie(sessioncookie); err == nil {
+		if name, ok := verifycookie(c.Value); ok {
+			return a.finduser(name), false
+		}
+	}
+	h := r.Header.Get("Authorization")
+	if strings.HasPrefix(h, "Bearer ") {
+		return a.tokenuser(strings.TrimPrefix(h, "Bearer ")), false
+	}
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, false
+	}
+	for _, u := range a.Users {
+		if u.Name == name && checkpassword(u.Password, password) {
+			return a.finduser(name), true
+		}
+	}
+	return nil, false
+}
+
+// tokenuser will return user of bearer token or nil.
+func (a *authconfig) tokenuser(token string) *authuser {
+	sum := sha256.Sum256([]byte(token))
+	got := hex.EncodeToString(sum[:])
+	for _, t := range a.Tokens {
+		if subtle.ConstantTimeCompare([]byte(strings.ToLower(t.Sha256)), []byte(got)) == 1 {
+			return a.finduser(t.User)
+		}
+	}
+	return nil
+}
+
+// finduser will return user with given name or nil.
+func (a *authconfig) finduser(name string) *authuser {
+	for _, u := range a.Users {
+		if u.Name == name {
+			return &authuser{name: u.Name, roles: u.Roles}
+		}
+	}
+	return nil
+}
+
+// checkpassword will compare password with bcrypt hash, successful checks
+// are cached with sha256 of password for verifiedttl.
+func checkpassword(hash string, password string) bool {
+	sum := sha256.Sum256([]byte(hash + "\x00" + password))
+	key := hex.EncodeToString(sum[:])
+	now := time.Now()
+	verified.mu.Lock()
+	expiry, got := verified.m[key]
+	verified.mu.Unlock()
+	if got && now.Before(expiry) {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return false
+	}
+	verified.mu.Lock()
+	defer verified.mu.Unlock()
+	if len(verified.m) >= maxverified {
+		for k, e := range verified.m {
+			if !now.Before(e) {
+				delete(verified.m, k)
+			}
+		}
+	}
+	// Still full with valid checks, oldest one is forgotten.
+	if len(verified.m) >= maxverified {
+		oldest := ""
+		for k, e := range verified.m {
+			if oldest == "" || e.Before(verified.m[oldest]) {
+				oldest = k
+			}
+		}
+		delete(verified.m, oldest)
+	}
+	verified.m[key] = now.Add(verifiedttl)
+	return true
+}
+
+// newcookie will return signed session cookie value for user.
+func newcookie(name string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(name)) + "." +
+		strconv.FormatInt(time.Now().Add(sessionttl).Unix(), 10)
+	return payload + "." + sign(payload)
+}
+
+// verifycookie will return user name of valid and unexpired cookie.
+func verifycookie(value string) (string, bool) {
+	index := strings.LastIndex(value, ".")
+	if index < 0 || !hmac.Equal([]byte(sign(value[:index])), []byte(value[index+1:])) {
+		return "", false
+	}
+	parts := strings.Split(value[:index], ".")
+	if len(parts) != 2 {
+		return "", false
+	}
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return "", false
+	}
+	name, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	return string(name), true
+}
+
+func sign(payload string) string {
+	m := hmac.New(sha256.New, cookiekey)
+	m.Write([]byte(payload))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// authmiddleware will authenticate every request except static UI files
+// and store user in request context. Authorization is done by handlers.
+func authmiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authenabled() || strings.HasPrefix(r.URL.Path, "/ui/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		u, basic := authenticate(r)
+		// Probes need no credentials, ports are shown only to users.
+		if u == nil && (r.URL.Path == "/healthz" || r.URL.Path == "/readyz") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if u == nil {
+			log.Printf("[Client:%s]Authentication failed for %s", r.RemoteAddr, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Basic realm="serial-port-websocket"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("Authentication required."))
+			return
+		}
+		if basic {
+			http.SetCookie(w, &http.Cookie{Name: sessioncookie, Value: newcookie(u.name),
+				Path: "/", HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteStrictMode,
+				MaxAge: int(sessionttl.Seconds())})
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userkey, u)))
+	})
+}
+
+// requestuser will return authenticated user of request or nil.
+func requestuser(r *http.Request) *authuser {
+	u, _ := r.Context().Value(userkey).(*authuser)
+	return u
+}
+
+// username will return name of authenticated user of request or empty string.
+func username(r *http.Request) string {
+	if u := requestuser(r); u != nil {
+		return u.name
+	}
+	return ""
+}
+
+// role will return role of user for given port, port specific binding
+// takes precedence over * binding.
+func (u *authuser) role(pname string) int {
+	if role, got := u.roles[pname]; got {
+		return rolenames[role]
+	}
+	return rolenames[u.roles["*"]]
+}
+
+// portrole will return role of request for port. Every request has admin
+// role when authentication is disabled.
+func portrole(r *http.Request, pname string) int {
+	if !authenabled() {
+		return roleAdmin
+	}
+	u := requestuser(r)
+	if u == nil {
+		return roleNone
+	}
+	return u.role(pname)
+}
+
+// authorize will check request has at least given role on port and write
+// forbidden response if not.
+func authorize(w http.ResponseWriter, r *http.Request, pname string, role int) bool {
+	if portrole(r, pname) >= role {
+		return true
+	}
+	log.Printf("[Client:%s Serial Port:%s]User %s not allowed for %s",
+		r.RemoteAddr, pname, username(r), r.URL.Path)
+	w.WriteHeader(http.StatusForbidden)
+	w.Write([]byte("Not allowed."))
+	return false
+}
+
+// withrole will wrap handler with authorization check for port given in
+// portname query, * is checked for requests without port.
+func withrole(role int, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pname := r.URL.Query().Get("portname")
+		if pname == "" {
+			pname = "*"
+		}
+		if !authorize(w, r, pname, role) {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// adminfiles are files in logs dir with data of every port, they are
+// served only to admins of all ports.
+var adminfiles = map[string]bool{"/" + auditfile: true, "/" + jobhistoryfile: true}
+
+// adminfile will return true if given file under logs dir or its rotated
+// backup needs admin role on all ports.
+func adminfile(file string) bool {
+	file = path.Clean("/" + file)
+	for name := range adminfiles {
+		ext := path.Ext(name)
+		if file == name || (strings.HasPrefix(file, strings.TrimSuffix(name, ext)+"-") &&
+			strings.HasSuffix(file, ext)) {
+			return true
+		}
+	}
+	return false
+}
+
+// logport will return port name for given file under logs directory or
+// empty string if file does not belong to any port.
+func logport(file string) string {
+	config.mu.Lock()
+	defer config.mu.Unlock()
+	base := filepath.Base(file)
+	for _, value := range config.Ports {
+		name := logname(value.Name)
+		if strings.HasPrefix(base, name+".") || strings.HasPrefix(base, name+"-") {
+			return value.Name
+		}
+	}
+	return ""
+}
+
+// hashpassword will print bcrypt hash of password for auth config.
+func hashpassword(password string) error {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
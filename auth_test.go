@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v2"
+)
+
+func TestRole(t *testing.T) {
+	u := &authuser{name: "alice", roles: map[string]string{"*": "viewer", "/dev/ttyUSB0": "admin", "lab": "bogus"}}
+	for pname, want := range map[string]int{
+		"/dev/ttyUSB0": roleAdmin,
+		"/dev/ttyUSB1": roleViewer,
+		"*":            roleViewer,
+		// Port binding wins over * even if its role is unknown.
+		"lab": roleNone,
+	} {
+		if got := u.role(pname); got != want {
+			t.Errorf("role(%s) = %d, want %d", pname, got, want)
+		}
+	}
+	nobody := &authuser{name: "bob", roles: map[string]string{"/dev/ttyUSB0": "operator"}}
+	if got := nobody.role("/dev/ttyUSB1"); got != roleNone {
+		t.Errorf("role without * binding = %d, want none", got)
+	}
+}
+
+func TestCookie(t *testing.T) {
+	value := newcookie("alice")
+	if name, ok := verifycookie(value); !ok || name != "alice" {
+		t.Fatalf("verifycookie(newcookie) = %q, %v", name, ok)
+	}
+	tampered := []byte(value)
+	tampered[0] ^= 1
+	expired := base64.RawURLEncoding.EncodeToString([]byte("alice")) + "." +
+		strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	forged := base64.RawURLEncoding.EncodeToString([]byte("root")) + value[len(base64.RawURLEncoding.EncodeToString([]byte("alice"))):]
+	for _, bad := range []string{"", "alice", string(tampered), forged, expired + "." + sign(expired),
+		"a.b.c." + sign("a.b.c")} {
+		if name, ok := verifycookie(bad); ok {
+			t.Errorf("verifycookie(%q) accepted as %q", bad, name)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("tok3n"))
+	var a authconfig
+	if err := yaml.Unmarshal([]byte(`
+enable: 1
+users:
+  - name: alice
+    password: `+string(hash)+`
+    roles: {"*": operator}
+tokens:
+  - name: ci
+    user: alice
+    sha256: `+hex.EncodeToString(sum[:])), &a); err != nil {
+		t.Fatal(err)
+	}
+	config.mu.Lock()
+	saved := config.Auth
+	config.Auth = a
+	config.mu.Unlock()
+	defer func() {
+		config.mu.Lock()
+		config.Auth = saved
+		config.mu.Unlock()
+	}()
+
+	tests := []struct {
+		name  string
+		setup func(r *http.Request)
+		user  string
+		basic bool
+	}{
+		{"none", func(r *http.Request) {}, "", false},
+		{"basic", func(r *http.Request) { r.SetBasicAuth("alice", "secret") }, "alice", true},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("alice", "guess") }, "", false},
+		{"unknown user", func(r *http.Request) { r.SetBasicAuth("mallory", "secret") }, "", false},
+		{"token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer tok3n") }, "alice", false},
+		{"wrong token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer guess") }, "", false},
+		{"cookie", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: sessioncookie, Value: newcookie("alice")}) },
+			"alice", false},
+		{"cookie of removed user", func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: sessioncookie, Value: newcookie("bob")})
+		}, "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/ports", nil)
+		tt.setup(r)
+		u, basic := authenticate(r)
+		name := ""
+		if u != nil {
+			name = u.name
+		}
+		if name != tt.user || basic != tt.basic {
+			t.Errorf("%s: authenticate = %q, %v, want %q, %v", tt.name, name, basic, tt.user, tt.basic)
+		}
+	}
+}
+
+func TestCheckpasswordCache(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := func(password string) string {
+		sum := sha256.Sum256([]byte(string(hash) + "\x00" + password))
+		return hex.EncodeToString(sum[:])
+	}
+	verified.mu.Lock()
+	saved := verified.m
+	verified.m = make(map[string]time.Time)
+	verified.mu.Unlock()
+	defer func() {
+		verified.mu.Lock()
+		verified.m = saved
+		verified.mu.Unlock()
+	}()
+
+	// Expired check is not trusted, bcrypt decides again.
+	verified.m[key("guess")] = time.Now().Add(-time.Second)
+	if checkpassword(string(hash), "guess") {
+		t.Errorf("expired cached check accepted wrong password")
+	}
+	if !checkpassword(string(hash), "secret") || verified.m[key("secret")].Before(time.Now()) {
+		t.Errorf("successful check not cached")
+	}
+
+	// Full cache drops expired checks first.
+	verified.m = make(map[string]time.Time)
+	for index := 0; index < maxverified; index++ {
+		expiry := time.Now().Add(time.Minute)
+		if index%2 == 0 {
+			expiry = time.Now().Add(-time.Minute)
+		}
+		verified.m[strconv.Itoa(index)] = expiry
+	}
+	checkpassword(string(hash), "secret")
+	if len(verified.m) != maxverified/2+1 {
+		t.Errorf("cache has %d checks after pruning, want %d", len(verified.m), maxverified/2+1)
+	}
+
+	// Full cache of valid checks forgets oldest one.
+	verified.m = make(map[string]time.Time)
+	for index := 0; index < maxverified; index++ {
+		verified.m[strconv.Itoa(index)] = time.Now().Add(time.Duration(index+1) * time.Second)
+	}
+	checkpassword(string(hash), "secret")
+	if _, got := verified.m["0"]; got || len(verified.m) != maxverified {
+		t.Errorf("cache of %d checks, oldest kept %v", len(verified.m), got)
+	}
+}
+
+func TestAdminfile(t *testing.T) {
+	for file, want := range map[string]bool{
+		"/audit.jsonl":                                 true,
+		"audit-2024-01-01T10-00-00.000.jsonl":          true,
+		"/jobs-2024-01-01T10-00-00.000.jsonl":          true,
+		"/../jobs.jsonl":                               true,
+		"/agent.log":                                   false,
+		"/jobruns/ttyUSB0-backup-20240101T100000Z.txt": false,
+		"/audit.jsonl.txt":                             false,
+	} {
+		if got := adminfile(file); got != want {
+			t.Errorf("adminfile(%s) = %v, want %v", file, got, want)
+		}
+	}
+}
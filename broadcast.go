@@ -0,0 +1,67 @@
+package main
+
+import (
+	"sync"
+)
+
+// subscriber will receive every chunk published on broadcaster.
+type subscriber struct {
+	ch chan []byte
+}
+
+// broadcaster will fan out data read from serial port to all
+// attached subscribers. Slow subscriber loses data instead of
+// blocking reader of port. Recent data is kept in scrollback
+// for subscribers attaching later.
+type broadcaster struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+	scrollback  *ringbuffer
+	// stats counts data dropped for slow subscribers.
+	stats *portstats
+}
+
+func newbroadcaster(scrollback int, stats *portstats) *broadcaster {
+	return &broadcaster{
+		subscribers: make(map[*subscriber]struct{}),
+		scrollback:  newringbuffer(scrollback),
+		stats:       stats,
+	}
+}
+
+// subscribe will register new subscriber and return scrollback data
+// published before it. Nothing is lost or repeated between both.
+func (b *broadcaster) subscribe() (*subscriber, []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := &subscriber{ch: make(chan []byte, 1024)}
+	b.subscribers[s] = struct{}{}
+	return s, b.scrollback.bytes()
+}
+
+// unsubscribe will remove given subscriber.
+func (b *broadcaster) unsubscribe(s *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers, s)
+}
+
+// publish will send copy of data to every subscriber.
+func (b *broadcaster) publish(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	tmp := make([]byte, len(data))
+	copy(tmp, data)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.scrollback.write(tmp)
+	for s := range b.subscribers {
+		select {
+		case s.ch <- tmp:
+		default:
+			b.stats.add(&b.stats.dropped, 1)
+			b.stats.add(&b.stats.droppedbytes, len(tmp))
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// capture log formats of port.
+const (
+	logRaw       = "raw"
+	logTimestamp = "timestamp"
+	logJSON      = "json"
+)
+
+// direction of captured data.
+const (
+	dirRx = "rx"
+	dirTx = "tx"
+	// dirMarker is marker written by trigger, not port data.
+	dirMarker = "marker"
+)
+
+// RFC 3339 with milliseconds, used for capture log timestamps.
+const capturetime = "2006-01-02T15:04:05.000Z07:00"
+
+// json capture keeps partial line at most this long before writing it.
+const (
+	captureflush   = time.Second
+	capturemaxline = 4096
+)
+
+// recorded input lines are marked with this prefix in raw and timestamp format.
+const inputmark = ">>> "
+
+// markers of triggers are marked with this prefix in raw and timestamp format.
+const markermark = "*** "
+
+// redacted replaces input typed at password prompt or marked secret.
+const redacted = "[redacted]"
+
+// passwordprompt matches last output line asking for secret input.
+var passwordprompt = regexp.MustCompile(`(?i)\b(password|passphrase|passcode|pin)\b[^\n]*[:>?]\s*$`)
+
+// captureline is single record of json capture log.
+type captureline struct {
+	Time     string `json:"time,omitempty"`
+	Dir      string `json:"dir"`
+	Session  string `json:"session,omitempty"`
+	Data     string `json:"data"`
+	Redacted bool   `json:"redacted,omitempty"`
+}
+
+// inputline is line being typed by a session, it is recorded once complete.
+type inputline struct {
+	buf    []byte
+	time   time.Time
+	secret bool
+	// lastcr tells last line ended with CR, so LF right after it is skipped.
+	lastcr bool
+}
+
+// capturelog will write data of port into log file in configured format.
+// Data of a line can come in several reads, so it tracks whether next byte
+// starts a new line. Timestamp is time of read which brought first byte of
+// line.
+type capturelog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+	// linestart tells next output byte starts a new line.
+	linestart bool
+	// partial line of json format with time and direction of its first byte.
+	partial     []byte
+	partialtime time.Time
+	partialdir  string
+	timer       *time.Timer
+	// recordinput enables recording of session input.
+	recordinput bool
+	inputs      map[string]*inputline
+	// tail is last output line, used to detect password prompts.
+	tail []byte
+}
+
+func newcapturelog(w io.Writer, format string, recordinput bool) *capturelog {
+	if format == "" {
+		format = logRaw
+	}
+	return &capturelog{w: w, format: format, linestart: true,
+		recordinput: recordinput, inputs: make(map[string]*inputline)}
+}
+
+// validlogformat will return true for supported capture log format.
+func validlogformat(format string) bool {
+	return format == "" || format == logRaw || format == logTimestamp || format == logJSON
+}
+
+// record will write data read at time t in given direction.
+func (c *capturelog) record(dir string, data []byte, t time.Time) {
+	if len(data) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.recordinput {
+		c.updatetail(data)
+	}
+	switch c.format {
+	case logTimestamp:
+		c.timestamped(data, t)
+	case logJSON:
+		c.jsonlines(dir, data, t)
+	default:
+		c.w.Write(data)
+		c.linestart = data[len(data)-1] == '\n'
+	}
+}
+
+// updatetail will keep last output line up to 256 bytes.
+func (c *capturelog) updatetail(data []byte) {
+	for _, b := range data {
+		if b == '\n' {
+			c.tail = c.tail[:0]
+			continue
+		}
+		c.tail = append(c.tail, b)
+	}
+	if len(c.tail) > 256 {
+		c.tail = append(c.tail[:0], c.tail[len(c.tail)-256:]...)
+	}
+}
+
+// input will record data typed by session who. Input is kept till line is
+// complete and written as single marked line, so keystrokes do not split
+// output lines. Line started at password prompt or marked secret is redacted.
+func (c *capturelog) input(who string, data []byte, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.recordinput {
+		return
+	}
+	in, got := c.inputs[who]
+	if !got {
+		in = &inputline{}
+		c.inputs[who] = in
+	}
+	for _, b := range data {
+		switch {
+		case b == '\n' && in.lastcr && len(in.buf) == 0:
+			in.lastcr = false
+		case b == '\r' || b == '\n':
+			c.inputstart(in, t)
+			c.writeinput(who, in)
+			in.lastcr = b == '\r'
+		case b == 0x7f || b == 0x08:
+			// Backspace removes last typed byte.
+			if len(in.buf) > 0 {
+				in.buf = in.buf[:len(in.buf)-1]
+			}
+		default:
+			c.inputstart(in, t)
+			in.buf = append(in.buf, b)
+			in.lastcr = false
+			if len(in.buf) >= capturemaxline {
+				c.writeinput(who, in)
+			}
+		}
+	}
+}
+
+// inputstart will note time and secrecy of line on its first byte.
+func (c *capturelog) inputstart(in *inputline, t time.Time) {
+	if in.time.IsZero() {
+		in.time = t
+		in.secret = in.secret || passwordprompt.Match(c.tail)
+	}
+}
+
+// secret will mark current or next input line of session who as secret.
+func (c *capturelog) secret(who string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.recordinput {
+		return
+	}
+	in, got := c.inputs[who]
+	if !got {
+		in = &inputline{}
+		c.inputs[who] = in
+	}
+	in.secret = true
+}
+
+// endinput will record unfinished input line of session who and forget it.
+func (c *capturelog) endinput(who string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if in, got := c.inputs[who]; got {
+		if len(in.buf) > 0 {
+			c.writeinput(who, in)
+		}
+		delete(c.inputs, who)
+	}
+}
+
+// writeinput will write input line in capture format and reset it. Caller
+// must hold mu.
+func (c *capturelog) writeinput(who string, in *inputline) {
+	data := string(in.buf)
+	if in.secret {
+		data = redacted
+	}
+	switch c.format {
+	case logJSON:
+		c.flush()
+		b, err := json.Marshal(captureline{Time: in.time.Format(capturetime), Dir: dirTx,
+			Session: who, Data: data, Redacted: in.secret})
+		if err == nil {
+			c.w.Write(append(b, '\n'))
+		}
+	default:
+		// Input goes on own line, output line in progress is ended first.
+		line := ""
+		if !c.linestart {
+			line = "\n"
+		}
+		if c.format == logTimestamp {
+			line = line + in.time.Format(capturetime) + " "
+		}
+		c.w.Write([]byte(line + inputmark + "[" + who + "] " + data + "\n"))
+		c.linestart = true
+	}
+	in.buf = in.buf[:0]
+	in.time = time.Time{}
+	in.secret = false
+}
+
+// marker will write given text on own line, used by triggers to mark
+// matched output in log.
+func (c *capturelog) marker(text string, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.format {
+	case logJSON:
+		c.flush()
+		b, err := json.Marshal(captureline{Time: t.Format(capturetime), Dir: dirMarker, Data: text})
+		if err == nil {
+			c.w.Write(append(b, '\n'))
+		}
+	default:
+		line := ""
+		if !c.linestart {
+			line = "\n"
+		}
+		if c.format == logTimestamp {
+			line = line + t.Format(capturetime) + " "
+		}
+		c.w.Write([]byte(line + markermark + text + "\n"))
+		c.linestart = true
+	}
+}
+
+// timestamped will prefix every line with time of its first byte.
+func (c *capturelog) timestamped(data []byte, t time.Time) {
+	prefix := []byte(t.Format(capturetime) + " ")
+	out := make([]byte, 0, len(data)+len(prefix))
+	for _, b := range data {
+		if c.linestart {
+			out = append(out, prefix...)
+			c.linestart = false
+		}
+		out = append(out, b)
+		if b == '\n' {
+			c.linestart = true
+		}
+	}
+	c.w.Write(out)
+}
+
+// jsonlines will write one record per line. Partial line is kept till its
+// end arrives, direction changes, it grows too long or captureflush passes.
+func (c *capturelog) jsonlines(dir string, data []byte, t time.Time) {
+	if len(c.partial) > 0 && c.partialdir != dir {
+		c.flush()
+	}
+	for len(data) > 0 {
+		if len(c.partial) == 0 {
+			c.partialtime = t
+			c.partialdir = dir
+		}
+		n := len(data)
+		for index, b := range data {
+			if b == '\n' {
+				n = index + 1
+				break
+			}
+		}
+		c.partial = append(c.partial, data[:n]...)
+		data = data[n:]
+		if c.partial[len(c.partial)-1] == '\n' || len(c.partial) >= capturemaxline {
+			c.flush()
+		}
+	}
+	if len(c.partial) > 0 && c.timer == nil {
+		// Timer fired while mu was held may run after newer one is armed,
+		// it must not flush partial line of newer timer.
+		var t *time.Timer
+		t = time.AfterFunc(captureflush, func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.timer != t {
+				return
+			}
+			c.timer = nil
+			c.flush()
+		})
+		c.timer = t
+	}
+}
+
+// flush will write partial line of json format and stop its flush timer,
+// next partial line gets full captureflush. Caller must hold mu.
+func (c *capturelog) flush() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.partial) == 0 {
+		return
+	}
+	b, err := json.Marshal(captureline{Time: c.partialtime.Format(capturetime),
+		Dir: c.partialdir, Data: string(c.partial)})
+	c.partial = c.partial[:0]
+	if err != nil {
+		return
+	}
+	c.w.Write(append(b, '\n'))
+}
+
+// setwriter will write pending partial line to current writer and switch
+// to given one.
+func (c *capturelog) setwriter(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flush()
+	c.w = w
+}
+
+// ensureline will end output line in progress, so that next write starts
+// on new line.
+func (c *capturelog) ensureline() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.linestart {
+		c.w.Write([]byte("\n"))
+		c.linestart = true
+	}
+}
+
+// setformat will write pending partial line and switch to given format,
+// used when logs default format changes on reload.
+func (c *capturelog) setformat(format string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flush()
+	c.format = format
+}
+
+// close will write pending partial line and stop flush timer.
+func (c *capturelog) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flush()
+	for who, in := range c.inputs {
+		if len(in.buf) > 0 {
+			c.writeinput(who, in)
+		}
+	}
+}
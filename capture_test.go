@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+var (
+	captured0 = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	captured1 = captured0.Add(time.Second)
+)
+
+func TestCaptureTimestampSplitsLines(t *testing.T) {
+	var buf bytes.Buffer
+	c := newcapturelog(&buf, logTimestamp, false)
+	c.record(dirRx, []byte("boot\nlog"), captured0)
+	c.record(dirRx, []byte("in: \n"), captured1)
+	c.record(dirRx, []byte("x"), captured1)
+	want := "2024-01-02T03:04:05.000Z boot\n2024-01-02T03:04:05.000Z login: \n2024-01-02T03:04:06.000Z x"
+	if got := buf.String(); got != want {
+		t.Errorf("log = %q, want %q", got, want)
+	}
+}
+
+func TestCaptureJSONLines(t *testing.T) {
+	var buf bytes.Buffer
+	c := newcapturelog(&buf, logJSON, false)
+	c.record(dirRx, []byte("a\nb"), captured0)
+	c.record(dirRx, []byte("c\nd"), captured1)
+	// Direction change ends partial line.
+	c.record(dirTx, []byte("q\n"), captured1)
+	c.close()
+	want := `{"time":"2024-01-02T03:04:05.000Z","dir":"rx","data":"a\n"}` + "\n" +
+		`{"time":"2024-01-02T03:04:05.000Z","dir":"rx","data":"bc\n"}` + "\n" +
+		`{"time":"2024-01-02T03:04:06.000Z","dir":"rx","data":"d"}` + "\n" +
+		`{"time":"2024-01-02T03:04:06.000Z","dir":"tx","data":"q\n"}` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("log = %q, want %q", got, want)
+	}
+}
+
+func TestCaptureJSONLongLine(t *testing.T) {
+	var buf bytes.Buffer
+	c := newcapturelog(&buf, logJSON, false)
+	c.record(dirRx, bytes.Repeat([]byte("x"), capturemaxline+10), captured0)
+	if n := bytes.Count(buf.Bytes(), []byte("\n")); n != 1 {
+		t.Errorf("line of %d bytes not flushed at capturemaxline, %d records", capturemaxline+10, n)
+	}
+	c.close()
+}
+
+func TestCaptureInput(t *testing.T) {
+	var buf bytes.Buffer
+	c := newcapturelog(&buf, logRaw, true)
+	c.record(dirRx, []byte("router> "), captured0)
+	// Keystrokes come one by one, backspace removes typo, CR LF ends line once.
+	for _, b := range []byte("shw\x7fow\r\n") {
+		c.input("alice", []byte{b}, captured1)
+	}
+	c.record(dirRx, []byte("version 1\n"), captured1)
+	c.input("bob", []byte("exi"), captured1)
+	c.endinput("bob")
+	want := "router> \n>>> [alice] show\nversion 1\n>>> [bob] exi\n"
+	if got := buf.String(); got != want {
+		t.Errorf("log = %q, want %q", got, want)
+	}
+}
+
+func TestCaptureRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	c := newcapturelog(&buf, logTimestamp, true)
+	c.record(dirRx, []byte("login: "), captured0)
+	c.input("alice", []byte("admin\r"), captured0)
+	c.record(dirRx, []byte("\nPassword: "), captured1)
+	c.input("alice", []byte("hunter2\r"), captured1)
+	c.record(dirRx, []byte("\nrouter# "), captured1)
+	c.secret("alice")
+	c.input("alice", []byte("enable secret s3\r"), captured1)
+	c.record(dirRx, []byte("\nrouter# "), captured1)
+	c.input("alice", []byte("show run\r"), captured1)
+	got := buf.String()
+	for _, secret := range []string{"hunter2", "s3"} {
+		if bytes.Contains(buf.Bytes(), []byte(secret)) {
+			t.Errorf("secret %q in log %q", secret, got)
+		}
+	}
+	want := "2024-01-02T03:04:05.000Z login: \n" +
+		"2024-01-02T03:04:05.000Z >>> [alice] admin\n" +
+		"2024-01-02T03:04:06.000Z \n" +
+		"2024-01-02T03:04:06.000Z Password: \n" +
+		"2024-01-02T03:04:06.000Z >>> [alice] [redacted]\n" +
+		"2024-01-02T03:04:06.000Z \n" +
+		"2024-01-02T03:04:06.000Z router# \n" +
+		"2024-01-02T03:04:06.000Z >>> [alice] [redacted]\n" +
+		"2024-01-02T03:04:06.000Z \n" +
+		"2024-01-02T03:04:06.000Z router# \n" +
+		"2024-01-02T03:04:06.000Z >>> [alice] show run\n"
+	if got != want {
+		t.Errorf("log = %q, want %q", got, want)
+	}
+}
+
+func TestCaptureInputJSON(t *testing.T) {
+	var buf bytes.Buffer
+	c := newcapturelog(&buf, logJSON, true)
+	c.record(dirRx, []byte("PIN? "), captured0)
+	c.input("bob", []byte("1234\n"), captured1)
+	c.close()
+	want := `{"time":"2024-01-02T03:04:05.000Z","dir":"rx","data":"PIN? "}` + "\n" +
+		`{"time":"2024-01-02T03:04:06.000Z","dir":"tx","session":"bob","data":"[redacted]","redacted":true}` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("log = %q, want %q", got, want)
+	}
+}
+
+func TestCaptureInputOff(t *testing.T) {
+	var buf bytes.Buffer
+	c := newcapturelog(&buf, logRaw, false)
+	c.input("alice", []byte("show\r"), captured0)
+	c.secret("alice")
+	c.endinput("alice")
+	if buf.Len() != 0 {
+		t.Errorf("input recorded with recordinput off: %q", buf.String())
+	}
+}
+
+func TestCaptureJSONFlushTimer(t *testing.T) {
+	var buf bytes.Buffer
+	c := newcapturelog(&buf, logJSON, false)
+	c.record(dirRx, []byte("login: "), captured0)
+	c.mu.Lock()
+	first := c.timer
+	c.mu.Unlock()
+	if first == nil {
+		t.Fatal("no flush timer for partial line")
+	}
+	// Line end flushes partial line and stops its timer, next partial line
+	// gets own timer.
+	c.record(dirRx, []byte("\nPassword: "), captured1)
+	c.mu.Lock()
+	second := c.timer
+	c.mu.Unlock()
+	if second == nil || second == first || first.Stop() {
+		t.Errorf("flush timer not restarted for next partial line")
+	}
+	c.close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil {
+		t.Errorf("flush timer armed after close")
+	}
+	want := `{"time":"2024-01-02T03:04:05.000Z","dir":"rx","data":"login: \n"}` + "\n" +
+		`{"time":"2024-01-02T03:04:06.000Z","dir":"rx","data":"Password: "}` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("log = %q, want %q", got, want)
+	}
+}
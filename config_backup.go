@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default number of old config versions kept.
+const defaultBackups = 10
+
+// backuptime is time format in backup file names, it sorts by time.
+const backuptime = "20060102T150405.000000000Z"
+
+// configfilemu makes sure only one config write runs at a time.
+var configfilemu sync.Mutex
+
+// written is sha256 of config file last written by server, guarded by
+// configfilemu.
+var written [sha256.Size]byte
+
+// configbackup struct is JSON info of config backup for API.
+type configbackup struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+}
+
+// backupcount will return number of backups to keep. Caller must hold mu.
+func (config *Config) backupcount() int {
+	if config.Backups <= 0 {
+		return defaultBackups
+	}
+	return config.Backups
+}
+
+// backupdir will return directory of backups of given config file.
+func backupdir(filename string) string {
+	return filepath.Join(filepath.Dir(filename), "config-backups")
+}
+
+// backupprefix will return file name prefix of backups of given config file.
+func backupprefix(filename string) string {
+	return strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename)) + "-"
+}
+
+// ownwrite will return true if data is config last written by server.
+func ownwrite(data []byte) bool {
+	configfilemu.Lock()
+	defer configfilemu.Unlock()
+	return sha256.Sum256(data) == written
+}
+
+// writeconfigfile will replace config file with data atomically. Data is
+// written to temp file in same directory, synced and renamed over config,
+// so crash or full disk never leaves partial config. Current config is
+// copied to backups first and only newest keep backups are kept.
+func writeconfigfile(filename string, data []byte, keep int) error {
+	configfilemu.Lock()
+	defer configfilemu.Unlock()
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(filename); err == nil {
+		mode = fi.Mode().Perm()
+		if err = backupconfig(filename, keep); err != nil {
+			return err
+		}
+	}
+	dir := filepath.Dir(filename)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), filename); err != nil {
+		return err
+	}
+	written = sha256.Sum256(data)
+	// Rename is durable only once directory is synced, not all platforms
+	// support it so error is ignored.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// backupconfig will copy current config file to backups dir and remove
+// backups older than newest keep ones.
+func backupconfig(filename string, keep int) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	dir := backupdir(filename)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	name := backupprefix(filename) + time.Now().UTC().Format(backuptime) + filepath.Ext(filename)
+	if err = ioutil.WriteFile(filepath.Join(dir, name), data, 0640); err != nil {
+		return err
+	}
+	backups, err := listbackups(filename)
+	if err != nil {
+		return err
+	}
+	for index := keep; index < len(backups); index++ {
+		if err = os.Remove(filepath.Join(dir, backups[index].Name)); err != nil {
+			log.Printf("Error removing old config backup %s: %s", backups[index].Name, err)
+		}
+	}
+	return nil
+}
+
+// listbackups will return backups of given config file, newest first.
+func listbackups(filename string) ([]configbackup, error) {
+	backups := []configbackup{}
+	files, err := ioutil.ReadDir(backupdir(filename))
+	if os.IsNotExist(err) {
+		return backups, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	prefix := backupprefix(filename)
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasPrefix(fi.Name(), prefix) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(fi.Name(), prefix), filepath.Ext(filename))
+		t, err := time.Parse(backuptime, stamp)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, configbackup{Name: fi.Name(), Time: t, Size: fi.Size()})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Time.After(backups[j].Time) })
+	return backups, nil
+}
+
+// getConfigBackups will return list of config backups.
+func getConfigBackups(w http.ResponseWriter, r *http.Request) {
+	backups, err := listbackups(*conf)
+	if err != nil {
+		log.Printf("[Client:%s]Error listing config backups: %s", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	writejson(w, backups)
+}
+
+// rollbackConfig will replace config file with given backup and apply it
+// like SIGHUP reload. Backup is validated first, current config is kept
+// as new backup so rollback can be undone.
+func rollbackConfig(w http.ResponseWriter, r *http.Request) {
+	// Config is written and applied without other change in between.
+	configchangemu.Lock()
+	defer configchangemu.Unlock()
+	name := r.FormValue("backup")
+	backups, err := listbackups(*conf)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	found := false
+	for _, b := range backups {
+		found = found || b.Name == name
+	}
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Backup not found."))
+		return
+	}
+	filename := filepath.Join(backupdir(*conf), name)
+	if err = (&Config{}).parseYaml(filename); err != nil {
+		log.Printf("[Client:%s]Config backup %s is invalid: %s", r.RemoteAddr, name, err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Backup is not valid config: " + err.Error()))
+		return
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	config.mu.Lock()
+	keep := config.backupcount()
+	config.mu.Unlock()
+	if err = writeconfigfile(*conf, data, keep); err != nil {
+		log.Printf("[Client:%s]Error writing config file: %s", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error writing config file: " + err.Error()))
+		return
+	}
+	log.Printf("[Client:%s]Config rolled back to %s.", r.RemoteAddr, name)
+	trigger := "rollback"
+	if user := username(r); user != "" {
+		trigger = trigger + " by " + user
+	}
+	if err = applyconfig(trigger); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Config rolled back but not applied: " + err.Error()))
+		return
+	}
+	w.Write([]byte("Config rolled back to " + name + "."))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteconfigfile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+	if err := writeconfigfile(file, []byte("v1\n"), 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(file, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"v2\n", "v3\n", "v4\n"} {
+		if err := writeconfigfile(file, []byte(v), 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil || string(data) != "v4\n" {
+		t.Fatalf("config = %q, %v", data, err)
+	}
+	if fi, err := os.Stat(file); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("mode of config not kept: %v %v", fi.Mode(), err)
+	}
+	backups, err := listbackups(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only newest 2 of 3 backups are kept, newest first.
+	var got []string
+	for _, b := range backups {
+		data, _ := ioutil.ReadFile(filepath.Join(backupdir(file), b.Name))
+		got = append(got, string(data))
+	}
+	if strings.Join(got, "") != "v3\nv2\n" {
+		t.Errorf("backups = %q, want v3 and v2", got)
+	}
+	// Watch skips only content server wrote last.
+	if !ownwrite([]byte("v4\n")) || ownwrite([]byte("v3\n")) {
+		t.Errorf("ownwrite does not match last written config")
+	}
+	files, _ := ioutil.ReadDir(dir)
+	for _, fi := range files {
+		if strings.Contains(fi.Name(), ".tmp") {
+			t.Errorf("temp file %s left behind", fi.Name())
+		}
+	}
+}
+
+func TestListbackupsSkipsOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.yaml")
+	os.MkdirAll(backupdir(file), 0755)
+	for _, name := range []string{"config-notatime.yaml", "other-20240102T030405.000000000Z.yaml",
+		"config-20240102T030405.000000000Z.yaml"} {
+		ioutil.WriteFile(filepath.Join(backupdir(file), name), nil, 0644)
+	}
+	backups, err := listbackups(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || backups[0].Name != "config-20240102T030405.000000000Z.yaml" {
+		t.Errorf("backups = %+v", backups)
+	}
+	if backups, err = listbackups(filepath.Join(t.TempDir(), "config.yaml")); err != nil || len(backups) != 0 {
+		t.Errorf("backups without dir = %+v, %v", backups, err)
+	}
+}
+
+func rollback(name string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/config/rollback", strings.NewReader(url.Values{"backup": {name}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rollbackConfig(w, r)
+	return w
+}
+
+func TestRollbackConfig(t *testing.T) {
+	dir := t.TempDir() + "/"
+	file := reloadtest(t, reloadfile(dir, "lab", "none"))
+	if err := writeconfigfile(file, []byte(reloadfile(dir, "broken", "maybe")), 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeconfigfile(file, []byte(reloadfile(dir, "new", "none")), 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadconfig("test"); err != nil {
+		t.Fatal(err)
+	}
+	backups, err := listbackups(file)
+	if err != nil || len(backups) != 2 {
+		t.Fatalf("backups = %+v, %v", backups, err)
+	}
+	if w := rollback("config-missing.yaml"); w.Code != http.StatusNotFound {
+		t.Errorf("rollback to missing backup: %d", w.Code)
+	}
+	// Newest backup is invalid config written over.
+	if w := rollback(backups[0].Name); w.Code != http.StatusBadRequest {
+		t.Errorf("rollback to invalid backup: %d %s", w.Code, w.Body)
+	}
+	if data, _ := ioutil.ReadFile(file); !strings.Contains(string(data), "desc: new") {
+		t.Errorf("config changed by rejected rollback: %s", data)
+	}
+	if w := rollback(backups[1].Name); w.Code != http.StatusOK {
+		t.Fatalf("rollback: %d %s", w.Code, w.Body)
+	}
+	if data, _ := ioutil.ReadFile(file); !strings.Contains(string(data), "desc: lab") {
+		t.Errorf("config after rollback: %s", data)
+	}
+	if got := config.Ports[0].Desc; got != "lab" {
+		t.Errorf("running config not reloaded after rollback, description %q", got)
+	}
+}
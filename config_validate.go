@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// configerrors is list of every problem found in config, each with YAML
+// path of field like ports[0].baudrate.
+type configerrors []string
+
+// add will record problem of field at given path.
+func (e *configerrors) add(path string, format string, args ...interface{}) {
+	*e = append(*e, path+": "+fmt.Sprintf(format, args...))
+}
+
+// Error will return all problems, one per line.
+func (e configerrors) Error() string {
+	return strconv.Itoa(len(e)) + " config error(s):\n  " + strings.Join(e, "\n  ")
+}
+
+// validate will check config and return every problem found, files like
+// TLS certificates are not checked as running servers already loaded them.
+func (config *Config) validate() error {
+	return config.check(false)
+}
+
+// checkport will validate config as it would be with port oldname replaced
+// by pc, or with pc added if oldname is empty, config is not changed.
+func (config *Config) checkport(oldname string, pc port) error {
+	config.mu.Lock()
+	candidate := &Config{Logs: config.Logs, ServerConfig: config.ServerConfig,
+		Timeouts: config.Timeouts, Backups: config.Backups, Health: config.Health, Auth: config.Auth}
+	replaced := false
+	for _, value := range config.Ports {
+		if oldname != "" && value.Name == oldname {
+			value = pc
+			replaced = true
+		}
+		candidate.Ports = append(candidate.Ports, value)
+	}
+	config.mu.Unlock()
+	if !replaced {
+		candidate.Ports = append(candidate.Ports, pc)
+	}
+	return candidate.validate()
+}
+
+// check will validate whole config and return configerrors with every
+// problem found or nil. files enables check of TLS certificate files.
+func (config *Config) check(files bool) error {
+	var errs configerrors
+	names := make(map[string]int)
+	lognames := make(map[string]int)
+	for index, value := range config.Ports {
+		path := fmt.Sprintf("ports[%d]", index)
+		switch first, got := names[value.Name]; {
+		case value.Name == "":
+			errs.add(path+".name", "must not be empty")
+		case got:
+			errs.add(path+".name", "duplicate of ports[%d]", first)
+		case value.Match == nil && !strings.HasPrefix(value.Name, "/"):
+			errs.add(path+".name", "must be device path like /dev/ttyUSB0 when match is not given")
+		}
+		if value.Name != "" {
+			if _, got := names[value.Name]; !got {
+				names[value.Name] = index
+			}
+			ln := logname(value.Name)
+			if first, got := lognames[ln]; got && config.Ports[first].Name != value.Name {
+				errs.add(path+".name", "log file %s.txt is same as of ports[%d]", ln, first)
+			} else if !got {
+				lognames[ln] = index
+			}
+		}
+		for _, fe := range value.lineconfig.fielderrors() {
+			errs.add(path+"."+fe.field, "%s", strings.TrimPrefix(fe.msg, fe.field+" "))
+		}
+		if value.Status != 1 && value.Status != 2 {
+			errs.add(path+".status", "must be 1 (enabled) or 2 (disabled)")
+		}
+		if value.Scrollback != nil && *value.Scrollback < 0 {
+			errs.add(path+".scrollback", "must not be negative")
+		}
+		if !validlogformat(value.Logformat) {
+			errs.add(path+".logformat", "must be raw, timestamp or json")
+		}
+		if value.Recordinput != 0 && value.Recordinput != 1 {
+			errs.add(path+".recordinput", "must be 0 or 1")
+		}
+		if value.Recordsession != 0 && value.Recordsession != 1 {
+			errs.add(path+".recordsession", "must be 0 or 1")
+		}
+		if value.Match != nil {
+			if err := value.Match.validate(); err != nil {
+				errs.add(path+".match", "%s", err)
+			}
+		}
+		if value.Maxidle < 0 {
+			errs.add(path+".maxidle", "must not be negative")
+		}
+		triggers := make(map[string]bool)
+		for tindex, tr := range value.Triggers {
+			tpath := fmt.Sprintf("%s.triggers[%d]", path, tindex)
+			tr.check(tpath, &errs)
+			if triggers[tr.Name] && tr.Name != "" {
+				errs.add(tpath+".name", "duplicate trigger %s", tr.Name)
+			}
+			triggers[tr.Name] = true
+		}
+		jobs := make(map[string]bool)
+		for jindex, j := range value.Jobs {
+			jpath := fmt.Sprintf("%s.jobs[%d]", path, jindex)
+			j.check(jpath, &errs)
+			if jobs[j.Name] {
+				errs.add(jpath+".name", "duplicate job %s", j.Name)
+			}
+			jobs[j.Name] = true
+		}
+	}
+
+	if config.Logs.Inlogs == "" {
+		errs.add("logs.inlogs", "must not be empty")
+	}
+	if config.Logs.Maxsize < 0 {
+		errs.add("logs.maxsize", "must not be negative")
+	}
+	if config.Logs.Maxbackups < 0 {
+		errs.add("logs.maxbackups", "must not be negative")
+	}
+	if config.Logs.Maxage < 0 {
+		errs.add("logs.maxage", "must not be negative")
+	}
+	if !validlogformat(config.Logs.Logformat) {
+		errs.add("logs.logformat", "must be raw, timestamp or json")
+	}
+
+	listening := make(map[int]int)
+	for index, value := range config.ServerConfig {
+		path := fmt.Sprintf("serverconfig[%d]", index)
+		if value.Enable != 1 && value.Enable != 2 {
+			errs.add(path+".enable", "must be 1 (enabled) or 2 (disabled)")
+		}
+		if value.Name != "http" && value.Name != "https" && value.Name != "tcp" {
+			errs.add(path+".name", "must be http, https or tcp")
+		}
+		if value.Port <= 0 || value.Port > 65535 {
+			errs.add(path+".port", "must be between 1 and 65535")
+		}
+		if value.Enable != 1 {
+			continue
+		}
+		if first, got := listening[value.Port]; got {
+			errs.add(path+".port", "same as of serverconfig[%d]", first)
+		} else {
+			listening[value.Port] = index
+		}
+		switch value.Name {
+		case "https":
+			for _, f := range []struct{ field, name string }{
+				{"sslcert", value.SslCert}, {"sslkey", value.SslKey}} {
+				if f.name == "" {
+					errs.add(path+"."+f.field, "must be given for https")
+				} else if _, err := os.Stat(f.name); files && err != nil {
+					errs.add(path+"."+f.field, "%s", err)
+				}
+			}
+		case "tcp":
+			if value.Mode != "raw" && value.Mode != "rfc2217" {
+				errs.add(path+".mode", "must be raw or rfc2217")
+			}
+			if _, got := names[value.Serialport]; !got {
+				errs.add(path+".serialport", "port %s is not configured", value.Serialport)
+			}
+			if config.Auth.Enable == 1 && value.User != "" {
+				if !loopback(value.Bind) {
+					errs.add(path+".bind", "must be loopback address like 127.0.0.1 when auth is enabled and user is given, tcp console does not ask for token")
+				}
+				if config.Auth.finduser(value.User) == nil {
+					errs.add(path+".user", "unknown user %s", value.User)
+				}
+			}
+		}
+	}
+
+	if config.Timeouts.Stop < 0 {
+		errs.add("timeouts.stop", "must not be negative")
+	}
+	if config.Timeouts.Shutdown < 0 {
+		errs.add("timeouts.shutdown", "must not be negative")
+	}
+	if config.Health.Maxdown < 0 {
+		errs.add("health.maxdown", "must not be negative")
+	}
+	if config.Health.Maxidle < 0 {
+		errs.add("health.maxidle", "must not be negative")
+	}
+	if config.Backups < 0 {
+		errs.add("backups", "must not be negative")
+	}
+	config.Auth.check(&errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
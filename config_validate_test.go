@@ -0,0 +1,210 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// validconfig is config without problems which tests break one by one.
+const validconfig = `
+ports:
+  - name: /dev/ttyUSB0
+    baudrate: 115200
+    status: 1
+  - name: switch1
+    baudrate: 9600
+    status: 2
+    match:
+      serialnumber: A1B2C3
+logs:
+  inlogs: /tmp/logs/
+  maxsize: 10
+serverconfig:
+  - name: http
+    enable: 1
+    port: 8080
+  - name: tcp
+    enable: 1
+    port: 7000
+    serialport: /dev/ttyUSB0
+    mode: raw
+`
+
+func testconfig(t *testing.T) *Config {
+	c := &Config{}
+	if err := yaml.Unmarshal([]byte(validconfig), c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// wanterrors will check config has exactly errors of given paths in order.
+func wanterrors(t *testing.T, c *Config, paths ...string) {
+	t.Helper()
+	err := c.validate()
+	if len(paths) == 0 {
+		if err != nil {
+			t.Errorf("unexpected errors: %s", err)
+		}
+		return
+	}
+	errs, ok := err.(configerrors)
+	if !ok {
+		t.Fatalf("error = %v, want configerrors", err)
+	}
+	if len(errs) != len(paths) {
+		t.Fatalf("errors = %q, want paths %q", []string(errs), paths)
+	}
+	for index, path := range paths {
+		if !strings.HasPrefix(errs[index], path+": ") {
+			t.Errorf("error %q, want path %s", errs[index], path)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	t.Run("valid", func(t *testing.T) { wanterrors(t, testconfig(t)) })
+	t.Run("empty name", func(t *testing.T) {
+		c := testconfig(t)
+		c.Ports[0].Name = ""
+		// tcp server of port is reported too.
+		wanterrors(t, c, "ports[0].name", "serverconfig[1].serialport")
+	})
+	t.Run("duplicate name", func(t *testing.T) {
+		c := testconfig(t)
+		c.Ports[1] = c.Ports[0]
+		wanterrors(t, c, "ports[1].name")
+	})
+	t.Run("name without match", func(t *testing.T) {
+		c := testconfig(t)
+		c.Ports[1].Match = nil
+		wanterrors(t, c, "ports[1].name")
+	})
+	t.Run("same log file", func(t *testing.T) {
+		c := testconfig(t)
+		c.Ports[1].Name = "/dev/serial/ttyUSB0"
+		wanterrors(t, c, "ports[1].name")
+	})
+	t.Run("line settings", func(t *testing.T) {
+		c := testconfig(t)
+		c.Ports[0].Baudrate = 0
+		c.Ports[0].Parity = "maybe"
+		wanterrors(t, c, "ports[0].baudrate", "ports[0].parity")
+	})
+	t.Run("port fields", func(t *testing.T) {
+		c := testconfig(t)
+		c.Ports[0].Status = 3
+		c.Ports[0].Scrollback = intp(-1)
+		c.Ports[0].Logformat = "xml"
+		c.Ports[0].Recordinput = 2
+		c.Ports[1].Match = &matcher{Vid: "0403"}
+		wanterrors(t, c, "ports[0].status", "ports[0].scrollback", "ports[0].logformat",
+			"ports[0].recordinput", "ports[1].match")
+	})
+	t.Run("duplicate trigger", func(t *testing.T) {
+		c := testconfig(t)
+		marker := []triggeraction{{Type: "marker"}}
+		// Trigger named like other port does not hide that port from
+		// tcp server check.
+		c.Ports[0].Triggers = []trigger{
+			{Name: "switch1", Regex: "panic", Actions: marker},
+			{Name: "switch1", Regex: "oops", Actions: marker},
+		}
+		c.ServerConfig[1].Serialport = "switch1"
+		wanterrors(t, c, "ports[0].triggers[1].name")
+	})
+	t.Run("logs", func(t *testing.T) {
+		c := testconfig(t)
+		c.Logs.Inlogs = ""
+		c.Logs.Maxage = -1
+		c.Logs.Logformat = "xml"
+		wanterrors(t, c, "logs.inlogs", "logs.maxage", "logs.logformat")
+	})
+	t.Run("server port", func(t *testing.T) {
+		c := testconfig(t)
+		c.ServerConfig[0].Port = 70000
+		c.ServerConfig[1].Port = 8080
+		wanterrors(t, c, "serverconfig[0].port")
+		c.ServerConfig[0].Port = 8080
+		wanterrors(t, c, "serverconfig[1].port")
+		// Disabled server does not take its port.
+		c.ServerConfig[0].Enable = 2
+		wanterrors(t, c)
+	})
+	t.Run("https without cert", func(t *testing.T) {
+		c := testconfig(t)
+		c.ServerConfig[0].Name = "https"
+		wanterrors(t, c, "serverconfig[0].sslcert", "serverconfig[0].sslkey")
+	})
+	t.Run("tcp", func(t *testing.T) {
+		c := testconfig(t)
+		c.ServerConfig[1].Mode = "ssh"
+		c.ServerConfig[1].Serialport = "/dev/ttyS9"
+		wanterrors(t, c, "serverconfig[1].mode", "serverconfig[1].serialport")
+	})
+	t.Run("tcp user with auth", func(t *testing.T) {
+		c := testconfig(t)
+		if err := yaml.Unmarshal([]byte(`
+enable: 1
+users:
+  - name: lab
+    password: $2a$10$CsFm60BiD8h199vFzdeK8Oy0Ay5miYJ/DCs0FuRV7VNwsFk/xkLQe
+`), &c.Auth); err != nil {
+			t.Fatal(err)
+		}
+		// Client is asked for token, any bind will do.
+		c.ServerConfig[1].Bind = "0.0.0.0"
+		wanterrors(t, c)
+		c.ServerConfig[1].User = "lab"
+		wanterrors(t, c, "serverconfig[1].bind")
+		for _, bind := range []string{"127.0.0.1", "::1", "localhost"} {
+			c.ServerConfig[1].Bind = bind
+			wanterrors(t, c)
+		}
+		c.ServerConfig[1].User = "bob"
+		wanterrors(t, c, "serverconfig[1].user")
+	})
+	t.Run("timeouts", func(t *testing.T) {
+		c := testconfig(t)
+		c.Timeouts.Stop = -1
+		c.Backups = -1
+		wanterrors(t, c, "timeouts.stop", "backups")
+	})
+}
+
+func TestCheckport(t *testing.T) {
+	c := testconfig(t)
+	pc := c.Ports[0]
+	pc.Baudrate = 0
+	if err := c.checkport(pc.Name, pc); err == nil || !strings.Contains(err.Error(), "ports[0].baudrate") {
+		t.Errorf("edit with bad baudrate: %v", err)
+	}
+	if err := c.checkport("", c.Ports[1]); err == nil || !strings.Contains(err.Error(), "ports[2].name: duplicate") {
+		t.Errorf("add of duplicate port: %v", err)
+	}
+	pc = c.Ports[1]
+	pc.Desc = "core switch"
+	if err := c.checkport(pc.Name, pc); err != nil {
+		t.Errorf("edit of description: %s", err)
+	}
+	if c.Ports[0].Baudrate != 115200 || len(c.Ports) != 2 || c.Ports[1].Desc != "" {
+		t.Errorf("checkport changed config: %+v", c.Ports)
+	}
+}
+
+func TestLogformat(t *testing.T) {
+	c := testconfig(t)
+	if got := c.logformat(c.Ports[0]); got != logRaw {
+		t.Errorf("built-in default = %s, want raw", got)
+	}
+	c.Logs.Logformat = logJSON
+	if got := c.logformat(c.Ports[0]); got != logJSON {
+		t.Errorf("logs default = %s, want json", got)
+	}
+	c.Ports[0].Logformat = logTimestamp
+	if got := c.logformat(c.Ports[0]); got != logTimestamp {
+		t.Errorf("port format = %s, want timestamp", got)
+	}
+}
@@ -1,37 +1,219 @@
 package main
 
 import (
+	"encoding/json"
 	"sync"
 )
 
+// session is single client attached to a port. Any number of sessions can
+// watch port output, only one of them holds write role at a time.
+type session struct {
+	id    uint64
+	raddr string
+	user  string
+	kind  string
+	// events will carry JSON control messages for client like role changes.
+	events chan []byte
+	// closed receives reason when server closes session.
+	closed chan string
+}
+
+// sessionstatus struct is sent to clients whenever roles on port change.
+type sessionstatus struct {
+	Type     string `json:"type"`
+	Role     string `json:"role,omitempty"`
+	Writer   string `json:"writer,omitempty"`
+	Sessions int    `json:"sessions,omitempty"`
+	From     string `json:"from,omitempty"`
+}
+
 type connection struct {
-	mu         sync.Mutex
-	connection int
-	raddr      string
+	mu       sync.Mutex
+	sessions map[uint64]*session
+	lastid   uint64
+	writer   *session
+	// pending sessions which requested write role from current writer.
+	pending []*session
+}
+
+// who will return user and remote address of session for logs.
+func (s *session) who() string {
+	if s.user != "" {
+		return s.user + "@" + s.raddr
+	}
+	return s.raddr
+}
+
+// attach will register new session for given remote address and user.
+// kind tells which client type is holding session e.g. websocket or api.
+func (connect *connection) attach(addr string, user string, kind string) *session {
+	connect.mu.Lock()
+	defer connect.mu.Unlock()
+	if connect.sessions == nil {
+		connect.sessions = make(map[uint64]*session)
+	}
+	connect.lastid = connect.lastid + 1
+	s := &session{
+		id:     connect.lastid,
+		raddr:  addr,
+		user:   user,
+		kind:   kind,
+		events: make(chan []byte, 16),
+		closed: make(chan string, 1),
+	}
+	connect.sessions[s.id] = s
+	connect.notifyall()
+	return s
+}
+
+// detach will remove session and hand over write role to first pending
+// session if removed session was writer.
+func (connect *connection) detach(s *session) {
+	connect.mu.Lock()
+	defer connect.mu.Unlock()
+	delete(connect.sessions, s.id)
+	connect.removepending(s)
+	if connect.writer == s {
+		connect.writer = nil
+		connect.promote()
+	}
+	connect.notifyall()
+}
+
+// requestwrite will give write role to session if nobody holds it. With
+// takeover, role is taken from current writer, otherwise writer is notified
+// and session waits till writer releases it. Returns true if role granted.
+func (connect *connection) requestwrite(s *session, takeover bool) bool {
+	connect.mu.Lock()
+	defer connect.mu.Unlock()
+	if _, got := connect.sessions[s.id]; !got {
+		return false
+	}
+	if connect.writer == s {
+		return true
+	}
+	if connect.writer == nil || takeover {
+		connect.removepending(s)
+		connect.writer = s
+		connect.notifyall()
+		return true
+	}
+	for _, value := range connect.pending {
+		if value == s {
+			return false
+		}
+	}
+	connect.pending = append(connect.pending, s)
+	connect.notify(connect.writer, sessionstatus{Type: "request", From: s.raddr})
+	return false
 }
 
-func (connect *connection) increment(addr string) {
+// trywrite will give write role to session only if nobody holds it.
+func (connect *connection) trywrite(s *session) bool {
 	connect.mu.Lock()
-	connect.connection = connect.connection + 1
-	connect.raddr = addr
-	connect.mu.Unlock()
+	defer connect.mu.Unlock()
+	if connect.writer != nil {
+		return connect.writer == s
+	}
+	connect.writer = s
+	connect.notifyall()
+	return true
 }
 
-func (connect *connection) decrement() {
+// release will give up write role of session, first pending session
+// will get it if any.
+func (connect *connection) release(s *session) {
 	connect.mu.Lock()
-	connect.connection = connect.connection - 1
-	connect.raddr = ""
-	connect.mu.Unlock()
+	defer connect.mu.Unlock()
+	if connect.writer != s {
+		return
+	}
+	connect.writer = nil
+	connect.promote()
+	connect.notifyall()
+}
+
+// iswriter will return true if session holds write role.
+func (connect *connection) iswriter(s *session) bool {
+	connect.mu.Lock()
+	defer connect.mu.Unlock()
+	return connect.writer == s
 }
 
 func (connect *connection) getconncount() int {
 	connect.mu.Lock()
 	defer connect.mu.Unlock()
-	return connect.connection
+	return len(connect.sessions)
 }
 
+// getraaddr will return remote address of writer session if any
+// otherwise of any attached session.
 func (connect *connection) getraaddr() string {
 	connect.mu.Lock()
 	defer connect.mu.Unlock()
-	return connect.raddr
+	if connect.writer != nil {
+		return connect.writer.raddr
+	}
+	for _, value := range connect.sessions {
+		return value.raddr
+	}
+	return ""
+}
+
+// promote will move write role to first pending session. Caller must hold lock.
+func (connect *connection) promote() {
+	if len(connect.pending) > 0 {
+		connect.writer = connect.pending[0]
+		connect.pending = connect.pending[1:]
+	}
+}
+
+// removepending will remove session from pending list. Caller must hold lock.
+func (connect *connection) removepending(s *session) {
+	for index, value := range connect.pending {
+		if value == s {
+			connect.pending = append(connect.pending[:index], connect.pending[index+1:]...)
+			return
+		}
+	}
+}
+
+// closeall will ask every session to close with given reason.
+func (connect *connection) closeall(reason string) {
+	connect.mu.Lock()
+	defer connect.mu.Unlock()
+	for _, value := range connect.sessions {
+		select {
+		case value.closed <- reason:
+		default:
+		}
+	}
+}
+
+// notifyall will send current role status to every session. Caller must hold lock.
+func (connect *connection) notifyall() {
+	var writer string
+	if connect.writer != nil {
+		writer = connect.writer.raddr
+	}
+	for _, value := range connect.sessions {
+		st := sessionstatus{Type: "status", Role: "viewer", Writer: writer,
+			Sessions: len(connect.sessions)}
+		if value == connect.writer {
+			st.Role = "writer"
+		}
+		connect.notify(value, st)
+	}
+}
+
+// notify will send message to session without blocking. Caller must hold lock.
+func (connect *connection) notify(s *session, st sessionstatus) {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return
+	}
+	select {
+	case s.events <- b:
+	default:
+	}
 }
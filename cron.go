@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronschedule is parsed cron expression with fields minute, hour, day of
+// month, month and day of week, each as bitmask of allowed values.
+type cronschedule struct {
+	minute, hour, dom, month, dow uint64
+	// domstar and dowstar are set if day field starts with * like * or */2.
+	// When both day fields are restricted, day matching either of them
+	// runs, as in cron.
+	domstar, dowstar bool
+}
+
+// cronmacros are shorthands of common schedules.
+var cronmacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronfield is range and names of values of one field.
+type cronfield struct {
+	name  string
+	min   int
+	max   int
+	names []string
+}
+
+var cronfields = []cronfield{
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day of month", 1, 31, nil},
+	{"month", 1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	// 7 is sunday too.
+	{"day of week", 0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+// parsecron will parse cron expression of five fields or macro like
+// @hourly. Fields take *, values, ranges a-b, steps */n or a-b/n and lists,
+// month and day of week take names like jan or mon too.
+func parsecron(spec string) (*cronschedule, error) {
+	if macro, got := cronmacros[strings.TrimSpace(spec)]; got {
+		spec = macro
+	}
+	parts := strings.Fields(spec)
+	if len(parts) != len(cronfields) {
+		return nil, errors.New("cron schedule needs 5 fields: minute hour day-of-month month day-of-week")
+	}
+	var masks [5]uint64
+	for index, part := range parts {
+		mask, err := parsecronfield(part, cronfields[index])
+		if err != nil {
+			return nil, err
+		}
+		masks[index] = mask
+	}
+	cs := &cronschedule{minute: masks[0], hour: masks[1], dom: masks[2], month: masks[3], dow: masks[4],
+		domstar: strings.HasPrefix(parts[2], "*"), dowstar: strings.HasPrefix(parts[4], "*")}
+	if cs.dow&(1<<7) != 0 {
+		cs.dow = cs.dow | 1
+	}
+	if cs.next(time.Now()).IsZero() {
+		return nil, errors.New("cron schedule never runs")
+	}
+	return cs, nil
+}
+
+// parsecronfield will return bitmask of values allowed by field.
+func parsecronfield(s string, f cronfield) (uint64, error) {
+	var mask uint64
+	for _, item := range strings.Split(s, ",") {
+		rng, step := item, 1
+		if index := strings.Index(item, "/"); index >= 0 {
+			rng = item[:index]
+			n, err := strconv.Atoi(item[index+1:])
+			if err != nil || n <= 0 {
+				return 0, errors.New("invalid step in " + f.name + " field: " + item)
+			}
+			step = n
+		}
+		lo, hi := f.min, f.max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = cronvalue(bounds[0], f); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = cronvalue(bounds[1], f); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				// a/n runs from a till end of range.
+				hi = f.max
+			}
+			if lo > hi {
+				return 0, errors.New("invalid range in " + f.name + " field: " + item)
+			}
+		}
+		for v := lo; v <= hi; v = v + step {
+			mask = mask | 1<<uint(v)
+		}
+	}
+	return mask, nil
+}
+
+// cronvalue will parse number or name of field value.
+func cronvalue(s string, f cronfield) (int, error) {
+	for index, name := range f.names {
+		if strings.EqualFold(s, name) {
+			return f.min + index, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, errors.New("invalid value in " + f.name + " field: " + s)
+	}
+	return v, nil
+}
+
+// next will return first time after t matching schedule, in location of t.
+// Zero time is returned if nothing matches in next five years.
+func (cs *cronschedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	loc := t.Location()
+	for t.Before(limit) {
+		switch {
+		case cs.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !cs.dayof(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case cs.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case cs.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayof will return true if day of t matches day fields.
+func (cs *cronschedule) dayof(t time.Time) bool {
+	dom := cs.dom&(1<<uint(t.Day())) != 0
+	dow := cs.dow&(1<<uint(t.Weekday())) != 0
+	if cs.domstar || cs.dowstar {
+		return dom && dow
+	}
+	return dom || dow
+}
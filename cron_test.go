@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsecron(t *testing.T) {
+	tests := []struct {
+		spec string
+		ok   bool
+	}{
+		{"* * * * *", true},
+		{"30 2 * * *", true},
+		{"*/15 9-17 * * mon-fri", true},
+		{"0 0 1,15 jan,jul *", true},
+		{"0 12 * * 7", true},
+		{"5/10 * * * *", true},
+		{"@hourly", true},
+		{" @daily ", true},
+		{"* * * *", false},
+		{"* * * * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"* * * 13 *", false},
+		{"* * * * 8", false},
+		{"*/0 * * * *", false},
+		{"*/x * * * *", false},
+		{"10-5 * * * *", false},
+		{"* * * foo *", false},
+		{"@never", false},
+		// February never has 30th day.
+		{"0 0 30 feb *", false},
+	}
+	for _, tt := range tests {
+		_, err := parsecron(tt.spec)
+		if (err == nil) != tt.ok {
+			t.Errorf("parsecron(%q) error = %v, want ok %v", tt.spec, err, tt.ok)
+		}
+	}
+}
+
+func TestParsecronfield(t *testing.T) {
+	tests := []struct {
+		s     string
+		field int
+		want  []int
+	}{
+		{"*", 1, nil},
+		{"5", 0, []int{5}},
+		{"1,3,5", 0, []int{1, 3, 5}},
+		{"10-13", 0, []int{10, 11, 12, 13}},
+		{"*/20", 0, []int{0, 20, 40}},
+		{"50/5", 0, []int{50, 55}},
+		{"1-10/4", 0, []int{1, 5, 9}},
+		{"mar-may", 3, []int{3, 4, 5}},
+		{"SUN,sat", 4, []int{0, 6}},
+	}
+	for _, tt := range tests {
+		f := cronfields[tt.field]
+		mask, err := parsecronfield(tt.s, f)
+		if err != nil {
+			t.Errorf("parsecronfield(%q) error %v", tt.s, err)
+			continue
+		}
+		var want uint64
+		if tt.want == nil {
+			for v := f.min; v <= f.max; v++ {
+				want = want | 1<<uint(v)
+			}
+		}
+		for _, v := range tt.want {
+			want = want | 1<<uint(v)
+		}
+		if mask != want {
+			t.Errorf("parsecronfield(%q) = %b, want %b", tt.s, mask, want)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// 2024-01-01 is monday.
+	at := func(s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		spec string
+		from string
+		want string
+	}{
+		{"* * * * *", "2024-01-01 10:00", "2024-01-01 10:01"},
+		{"30 2 * * *", "2024-01-01 10:00", "2024-01-02 02:30"},
+		{"30 2 * * *", "2024-01-01 02:29", "2024-01-01 02:30"},
+		{"*/15 * * * *", "2024-01-01 10:46", "2024-01-01 11:00"},
+		{"0 9 * * mon-fri", "2024-01-05 10:00", "2024-01-08 09:00"},
+		{"0 0 1 * *", "2024-01-15 00:00", "2024-02-01 00:00"},
+		{"0 0 29 feb *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		{"0 0 * * 7", "2024-01-01 00:00", "2024-01-07 00:00"},
+		{"@hourly", "2024-01-01 10:59", "2024-01-01 11:00"},
+		{"0 0 31 dec *", "2024-12-31 00:00", "2025-12-31 00:00"},
+		// Both day fields restricted, either one matches.
+		{"0 0 15 * fri", "2024-01-01 00:00", "2024-01-05 00:00"},
+		{"0 0 3 * fri", "2024-01-01 00:00", "2024-01-03 00:00"},
+		// Day field with step counts as * like in cron, both must match.
+		{"0 0 */2 * mon", "2024-01-01 00:00", "2024-01-15 00:00"},
+		{"0 0 13 * */7", "2024-01-01 00:00", "2024-10-13 00:00"},
+	}
+	for _, tt := range tests {
+		cs, err := parsecron(tt.spec)
+		if err != nil {
+			t.Errorf("parsecron(%q) error %v", tt.spec, err)
+			continue
+		}
+		if got := cs.next(at(tt.from)); !got.Equal(at(tt.want)) {
+			t.Errorf("%q next after %s = %s, want %s", tt.spec, tt.from, got.Format("2006-01-02 15:04 Mon"), tt.want)
+		}
+	}
+}
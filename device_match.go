@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"go.bug.st/serial/enumerator"
+)
+
+// matcher identifies serial device of port by USB identity or by-id link
+// instead of tty path, which can change after reboot or replug.
+type matcher struct {
+	Vid          string `yaml:"vid,omitempty" json:"vid,omitempty"`
+	Pid          string `yaml:"pid,omitempty" json:"pid,omitempty"`
+	Serialnumber string `yaml:"serialnumber,omitempty" json:"serialnumber,omitempty"`
+	// Byid is name or full path of link under /dev/serial/by-id.
+	Byid string `yaml:"byid,omitempty" json:"byid,omitempty"`
+}
+
+// validate will check matcher has enough to identify single device.
+func (m *matcher) validate() error {
+	if m.Byid != "" {
+		if m.Vid != "" || m.Pid != "" || m.Serialnumber != "" {
+			return errors.New("match byid can not be combined with vid, pid or serialnumber")
+		}
+		return nil
+	}
+	if m.Serialnumber == "" && (m.Vid == "" || m.Pid == "") {
+		return errors.New("match needs byid, serialnumber or both vid and pid")
+	}
+	return nil
+}
+
+// byidpath will return full path of by-id link.
+func (m *matcher) byidpath() string {
+	if strings.HasPrefix(m.Byid, "/") {
+		return m.Byid
+	}
+	return serialbyid + m.Byid
+}
+
+// matches will return true if device details and its by-id link match.
+func (m *matcher) matches(d *enumerator.PortDetails, byid string) bool {
+	if m.Byid != "" {
+		return byid != "" && byid == m.byidpath()
+	}
+	if !d.IsUSB {
+		return false
+	}
+	return (m.Vid == "" || strings.EqualFold(m.Vid, d.VID)) &&
+		(m.Pid == "" || strings.EqualFold(m.Pid, d.PID)) &&
+		(m.Serialnumber == "" || m.Serialnumber == d.SerialNumber)
+}
+
+// resolve will return current tty path of matched device. It fails if no
+// device or more than one device matches.
+func (m *matcher) resolve() (string, error) {
+	if m.Byid != "" {
+		path, err := filepath.EvalSymlinks(m.byidpath())
+		if err != nil {
+			return "", fmt.Errorf("no device for %s: %s", m.byidpath(), err)
+		}
+		return path, nil
+	}
+	list, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return "", err
+	}
+	var found []string
+	for _, value := range list {
+		if m.matches(value, "") {
+			found = append(found, value.Name)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no device matching %s", m.summary())
+	case 1:
+		return found[0], nil
+	}
+	return "", fmt.Errorf("%d devices matching %s: %s", len(found), m.summary(),
+		strings.Join(found, ", "))
+}
+
+// summary will return matcher in short form for logs.
+func (m *matcher) summary() string {
+	if m.Byid != "" {
+		return "byid " + m.Byid
+	}
+	s := "usb " + m.Vid + ":" + m.Pid
+	if m.Serialnumber != "" {
+		s = s + " serial " + m.Serialnumber
+	}
+	return s
+}
+
+// byidlinks will return by-id link of every device which has one.
+func byidlinks() map[string]string {
+	byid := make(map[string]string)
+	files, err := ioutil.ReadDir(serialbyid)
+	if err != nil {
+		return byid
+	}
+	for _, f := range files {
+		if target, err := filepath.EvalSymlinks(serialbyid + f.Name()); err == nil {
+			byid[target] = serialbyid + f.Name()
+		}
+	}
+	return byid
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+
+	"go.bug.st/serial/enumerator"
+)
+
+// stable symlinks of serial devices created by udev.
+const serialbyid = "/dev/serial/by-id/"
+
+// discoveredport is serial device found on system.
+type discoveredport struct {
+	Name         string `json:"name"`
+	Usb          bool   `json:"usb"`
+	Vid          string `json:"vid,omitempty"`
+	Pid          string `json:"pid,omitempty"`
+	Serialnumber string `json:"serialnumber,omitempty"`
+	Product      string `json:"product,omitempty"`
+	// Byid is stable /dev/serial/by-id path of device if any.
+	Byid string `json:"byid,omitempty"`
+	// Configured is name of configured port using this device if any.
+	Configured string `json:"configured,omitempty"`
+}
+
+// discoverports will list serial devices of system and mark ones already
+// configured, by device path, by symlink pointing to it or by matcher.
+func discoverports() ([]discoveredport, error) {
+	list, err := enumerator.GetDetailedPortsList()
+	if err != nil {
+		return nil, err
+	}
+	byid := byidlinks()
+	configured := make(map[string]string)
+	matchers := make(map[string]*matcher)
+	all.mu.Lock()
+	for name, sp := range all.ports {
+		if sp.match != nil {
+			matchers[name] = sp.match
+			continue
+		}
+		configured[name] = name
+		if target, err := filepath.EvalSymlinks(name); err == nil {
+			configured[target] = name
+		}
+	}
+	all.mu.Unlock()
+
+	ports := []discoveredport{}
+	for _, value := range list {
+		for name, m := range matchers {
+			if m.matches(value, byid[value.Name]) {
+				configured[value.Name] = name
+			}
+		}
+		ports = append(ports, discoveredport{
+			Name:         value.Name,
+			Usb:          value.IsUSB,
+			Vid:          value.VID,
+			Pid:          value.PID,
+			Serialnumber: value.SerialNumber,
+			Product:      value.Product,
+			Byid:         byid[value.Name],
+			Configured:   configured[value.Name],
+		})
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Name < ports[j].Name })
+	return ports, nil
+}
+
+// discoverPorts will return serial devices of system as JSON.
+func discoverPorts(w http.ResponseWriter, r *http.Request) {
+	ports, err := discoverports()
+	if err != nil {
+		log.Printf("[Client:%s]Error listing serial devices: %s", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error listing serial devices: " + err.Error()))
+		return
+	}
+	b, err := json.Marshal(ports)
+	if err != nil {
+		log.Printf("Error in JSON Marshal: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// health struct as per yaml config, thresholds of port readiness.
+type health struct {
+	// Maxdown is how long enabled port may stay not open before it is
+	// reported not ready.
+	Maxdown time.Duration `yaml:"maxdown,omitempty"`
+	// Maxidle is how long open port may be without any byte read before
+	// it is reported not ready, 0 disables. Port can override it.
+	Maxidle time.Duration `yaml:"maxidle,omitempty"`
+}
+
+// default time enabled port may stay not open.
+const defaultMaxdown = 30 * time.Second
+
+// alivetimeout is how long liveness check waits for locks of service.
+const alivetimeout = 5 * time.Second
+
+// loadstate tracks when config was loaded and last reload error.
+var loadstate = struct {
+	mu        sync.Mutex
+	loaded    time.Time
+	reloaderr string
+}{}
+
+// configloaded will record result of config load or reload, failed reload
+// keeps running config so it is loaded still.
+func configloaded(err error) {
+	loadstate.mu.Lock()
+	defer loadstate.mu.Unlock()
+	if err != nil {
+		loadstate.reloaderr = err.Error()
+		return
+	}
+	loadstate.loaded = time.Now()
+	loadstate.reloaderr = ""
+}
+
+// touch will record time of last byte read from port.
+func (ps *portstats) touch(t time.Time) {
+	atomic.StoreInt64(&ps.lastread, t.UnixNano())
+}
+
+// lastdata will return time of last byte read from port or zero time.
+func (ps *portstats) lastdata() time.Time {
+	n := atomic.LoadInt64(&ps.lastread)
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+// portready struct is readiness of single port.
+type portready struct {
+	Name     string     `json:"name"`
+	State    string     `json:"state"`
+	Ready    bool       `json:"ready"`
+	Since    time.Time  `json:"since"`
+	Lastdata *time.Time `json:"lastdata,omitempty"`
+	// Idle is seconds since last byte or since port was opened.
+	Idle    float64 `json:"idleseconds,omitempty"`
+	Problem string  `json:"problem,omitempty"`
+}
+
+// readiness struct is response of /readyz.
+type readiness struct {
+	Ready           bool              `json:"ready"`
+	Checks          map[string]string `json:"checks"`
+	Lastreloaderror string            `json:"lastreloaderror,omitempty"`
+	Ports           []portready       `json:"ports"`
+}
+
+// alive will return true if main locks of service can be taken, so that
+// deadlocked service is restarted by watchdog.
+func alive() bool {
+	done := make(chan struct{})
+	go func() {
+		all.mu.Lock()
+		all.mu.Unlock()
+		config.mu.Lock()
+		config.mu.Unlock()
+		servers.mu.Lock()
+		servers.mu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(alivetimeout):
+		return false
+	}
+}
+
+// listenersdown will return problem if any enabled listener is not
+// listening.
+func listenersdown() string {
+	config.mu.Lock()
+	list := append([]server(nil), config.ServerConfig...)
+	config.mu.Unlock()
+	servers.mu.Lock()
+	defer servers.mu.Unlock()
+	for _, value := range list {
+		if value.Enable != 1 {
+			continue
+		}
+		_, ishttp := servers.http[value]
+		_, istcp := servers.tcp[value]
+		if !ishttp && !istcp {
+			return value.Name + " server on port " + strconv.Itoa(value.Port) + " is not listening"
+		}
+	}
+	return ""
+}
+
+// logswritable will return error if file can not be created in logs dir.
+func logswritable() error {
+	config.mu.Lock()
+	dir := config.Logs.Inlogs
+	config.mu.Unlock()
+	f, err := ioutil.TempFile(dir, ".readyz")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// readyof will return readiness of port as per thresholds.
+func (sp *serialport) readyof(now time.Time) portready {
+	sp.mu.Lock()
+	st := sp.st
+	sp.mu.Unlock()
+	pr := portready{Name: sp.name, State: statenames[st.state], Ready: true, Since: st.since.UTC()}
+	config.mu.Lock()
+	maxdown := config.Health.Maxdown
+	maxidle := config.Health.Maxidle
+	config.mu.Unlock()
+	if pc, err := config.getElement(sp.name); err == nil && pc.Maxidle > 0 {
+		maxidle = pc.Maxidle
+	}
+	if maxdown <= 0 {
+		maxdown = defaultMaxdown
+	}
+	last := sp.stats.lastdata()
+	if !last.IsZero() {
+		t := last.UTC()
+		pr.Lastdata = &t
+	}
+	switch st.state {
+	case stateDisabled:
+	case stateOpen:
+		from := st.since
+		if last.After(from) {
+			from = last
+		}
+		pr.Idle = now.Sub(from).Seconds()
+		if maxidle > 0 && now.Sub(from) > maxidle {
+			pr.Ready = false
+			pr.Problem = "no data for more than " + maxidle.String()
+		}
+	default:
+		if now.Sub(st.since) > maxdown {
+			pr.Ready = false
+			pr.Problem = "not open for more than " + maxdown.String()
+			if st.lasterr != "" {
+				pr.Problem = pr.Problem + ": " + st.lasterr
+			}
+		}
+	}
+	return pr
+}
+
+// getHealthz is liveness probe, it fails only if service is stuck.
+func getHealthz(w http.ResponseWriter, r *http.Request) {
+	if !alive() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("Service is not responding."))
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// getReadyz is readiness probe. It checks config is loaded, listeners are
+// up and logs dir is writable, and reports readiness of ports user can
+// view. Ports make it fail only with strict=1.
+func getReadyz(w http.ResponseWriter, r *http.Request) {
+	rd := readiness{Ready: true, Checks: make(map[string]string), Ports: []portready{}}
+	check := func(name string, problem string) {
+		if problem == "" {
+			rd.Checks[name] = "ok"
+			return
+		}
+		rd.Checks[name] = problem
+		rd.Ready = false
+	}
+	loadstate.mu.Lock()
+	loaded := !loadstate.loaded.IsZero()
+	rd.Lastreloaderror = loadstate.reloaderr
+	loadstate.mu.Unlock()
+	if loaded {
+		check("config", "")
+	} else {
+		check("config", "config is not loaded")
+	}
+	if shuttingdown() {
+		check("listeners", "shutting down")
+	} else {
+		check("listeners", listenersdown())
+	}
+	if err := logswritable(); err != nil {
+		check("logs", err.Error())
+	} else {
+		check("logs", "")
+	}
+
+	all.mu.Lock()
+	var ports []*serialport
+	for _, sp := range all.ports {
+		ports = append(ports, sp)
+	}
+	all.mu.Unlock()
+	now := time.Now()
+	strict := r.FormValue("strict") == "1"
+	for _, sp := range ports {
+		if portrole(r, sp.name) < roleViewer {
+			continue
+		}
+		pr := sp.readyof(now)
+		if strict && !pr.Ready {
+			rd.Ready = false
+		}
+		rd.Ports = append(rd.Ports, pr)
+	}
+	sort.Slice(rd.Ports, func(i, j int) bool { return rd.Ports[i].Name < rd.Ports[j].Name })
+	if !rd.Ready {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	writejson(w, rd)
+}
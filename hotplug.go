@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// retry interval of opening port which failed, it doubles on every failed
+// attempt. Hotplug event retries at once where hotplug is supported.
+const (
+	openretrymin = time.Second
+	openretrymax = 30 * time.Second
+)
+
+// hotplugnotifier wakes readers waiting for their device when devices
+// appear on system.
+type hotplugnotifier struct {
+	mu      sync.Mutex
+	waiters map[chan struct{}]struct{}
+}
+
+var hotplug = hotplugnotifier{waiters: make(map[chan struct{}]struct{})}
+
+// subscribe will return channel which receives on next device event.
+func (h *hotplugnotifier) subscribe() chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan struct{}, 1)
+	h.waiters[ch] = struct{}{}
+	return ch
+}
+
+// unsubscribe will remove given channel.
+func (h *hotplugnotifier) unsubscribe(ch chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.waiters, ch)
+}
+
+// added will wake every waiting reader, events are coalesced.
+func (h *hotplugnotifier) added() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.waiters {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// removed will close open ports whose device is gone, so that reader
+// notices it at once instead of on next read.
+func (h *hotplugnotifier) removed() {
+	all.mu.Lock()
+	defer all.mu.Unlock()
+	for name, sp := range all.ports {
+		if sp.port == nil || sp.device == "" {
+			continue
+		}
+		if _, err := os.Stat(sp.device); err != nil {
+			log.Printf("Port:%s device:%s removed, closing port.", name, sp.device)
+			sp.port.Close()
+		}
+	}
+}
+
+// nextretry will return doubled retry interval up to openretrymax.
+func nextretry(d time.Duration) time.Duration {
+	d = d * 2
+	if d > openretrymax {
+		d = openretrymax
+	}
+	return d
+}
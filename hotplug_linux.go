@@ -0,0 +1,133 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// inotify events of device nodes and links appearing and disappearing.
+const (
+	inotifyadded   = unix.IN_CREATE | unix.IN_MOVED_TO | unix.IN_ATTRIB
+	inotifyremoved = unix.IN_DELETE | unix.IN_MOVED_FROM
+)
+
+// inotifywatcher watches /dev and directories of configured ports.
+type inotifywatcher struct {
+	fd   int
+	mu   sync.Mutex
+	dirs map[int]string
+}
+
+// starthotplug will watch device directories with inotify and notify
+// readers on device changes. Readers fall back to polling if it fails.
+func starthotplug() {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		log.Printf("Hotplug detection not available: %s. Polling ports.", err)
+		return
+	}
+	w := &inotifywatcher{fd: fd, dirs: make(map[int]string)}
+	w.addwatches()
+	go func() {
+		// Directories of ports added later are picked up periodically.
+		for range time.Tick(30 * time.Second) {
+			w.addwatches()
+		}
+	}()
+	go w.run()
+	log.Printf("Hotplug detection started.")
+}
+
+// watchdirs will return directories where devices of ports appear.
+func watchdirs() []string {
+	dirs := []string{"/dev", "/dev/serial", serialbyid}
+	all.mu.Lock()
+	defer all.mu.Unlock()
+	for name, sp := range all.ports {
+		switch {
+		case sp.match == nil:
+			dirs = append(dirs, filepath.Dir(name))
+		case sp.match.Byid != "":
+			dirs = append(dirs, filepath.Dir(sp.match.byidpath()))
+		}
+	}
+	return dirs
+}
+
+// addwatches will watch directories not yet watched, missing ones are
+// tried again later.
+func (w *inotifywatcher) addwatches() {
+	for _, dir := range watchdirs() {
+		dir = filepath.Clean(dir)
+		w.mu.Lock()
+		watched := false
+		for _, d := range w.dirs {
+			watched = watched || d == dir
+		}
+		w.mu.Unlock()
+		if watched {
+			continue
+		}
+		wd, err := unix.InotifyAddWatch(w.fd, dir, inotifyadded|inotifyremoved)
+		if err != nil {
+			continue
+		}
+		w.mu.Lock()
+		w.dirs[wd] = dir
+		w.mu.Unlock()
+	}
+}
+
+// run will read inotify events for ever. Only tty nodes are of interest
+// in /dev, any change in other watched directories is passed on.
+func (w *inotifywatcher) run() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := unix.Read(w.fd, buf)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			log.Printf("Hotplug detection stopped: %s. Polling ports.", err)
+			return
+		}
+		var added, removed, newdir bool
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			name := string(buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)])
+			name = strings.TrimRight(name, "\x00")
+			offset = offset + unix.SizeofInotifyEvent + int(event.Len)
+			w.mu.Lock()
+			dir := w.dirs[int(event.Wd)]
+			if event.Mask&unix.IN_IGNORED != 0 {
+				delete(w.dirs, int(event.Wd))
+			}
+			w.mu.Unlock()
+			// /dev/serial/by-id appears with first serial device.
+			newdir = newdir || event.Mask&(unix.IN_CREATE|unix.IN_ISDIR) == unix.IN_CREATE|unix.IN_ISDIR
+			if dir == "/dev" && !strings.HasPrefix(name, "tty") {
+				continue
+			}
+			added = added || event.Mask&inotifyadded != 0
+			removed = removed || event.Mask&inotifyremoved != 0
+		}
+		if newdir {
+			w.addwatches()
+		}
+		if removed {
+			hotplug.removed()
+		}
+		if added {
+			hotplug.added()
+		}
+	}
+}
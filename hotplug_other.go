@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"log"
+)
+
+// starthotplug is not supported on this platform, readers poll ports.
+func starthotplug() {
+	log.Printf("Hotplug detection not available on this platform. Polling ports.")
+}
@@ -0,0 +1,615 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// what scheduled run does if other session holds write role of port.
+const (
+	busySkip  = "skip"
+	busyQueue = "queue"
+)
+
+const (
+	// jobSkipped is status of run which did not start.
+	jobSkipped = "skipped"
+	// maxjoboutput is port output of run kept in output file of run.
+	maxjoboutput = 64 * 1024
+	// jobhistoryfile is run history under logs dir, rotated as per logs
+	// config. It has only metadata of runs, output is in jobrunsdir.
+	jobhistoryfile = "jobs.jsonl"
+	// artifactsdir keeps job outputs under logs dir.
+	artifactsdir = "artifacts/"
+	// jobrunsdir keeps port output of every run under logs dir, files
+	// older than logs maxage are removed.
+	jobrunsdir = "jobruns/"
+)
+
+// jobnamere limits job and artifact names as they are used in paths.
+var jobnamere = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// job struct as per yaml config, script run on port by cron schedule.
+type job struct {
+	Name string `yaml:"name" json:"name"`
+	// Schedule is cron expression in local time, e.g. "0 * * * *" or
+	// @daily.
+	Schedule string `yaml:"schedule" json:"schedule"`
+	// Busy is skip (default) or queue. Queued run waits for write role
+	// till next scheduled run.
+	Busy string `yaml:"busy,omitempty" json:"busy,omitempty"`
+	// Artifact is name port output of successful run is stored under.
+	Artifact string `yaml:"artifact,omitempty" json:"artifact,omitempty"`
+	Script   script `yaml:"script" json:"script"`
+}
+
+// check will add problems of job at given path to errs.
+func (j *job) check(path string, errs *configerrors) {
+	if !jobnamere.MatchString(j.Name) {
+		errs.add(path+".name", "must be letters, digits, _, . or -")
+	}
+	if _, err := parsecron(j.Schedule); err != nil {
+		errs.add(path+".schedule", "%s", err)
+	}
+	if j.Busy != "" && j.Busy != busySkip && j.Busy != busyQueue {
+		errs.add(path+".busy", "must be skip or queue")
+	}
+	if j.Artifact != "" && !jobnamere.MatchString(j.Artifact) {
+		errs.add(path+".artifact", "must be letters, digits, _, . or -")
+	}
+	j.Script.check(path+".script", errs)
+}
+
+// jobrun is record of one run of job in history.
+type jobrun struct {
+	Port string `json:"port"`
+	Job  string `json:"job"`
+	// Trigger is schedule or manual with user.
+	Trigger string    `json:"trigger"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	// Status is ok, failed, aborted or skipped.
+	Status string            `json:"status"`
+	Error  string            `json:"error,omitempty"`
+	Vars   map[string]string `json:"vars,omitempty"`
+	// Output is path of port output of run under /logs/.
+	Output    string `json:"output,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+	// Artifact is path of stored output under /logs/.
+	Artifact string `json:"artifact,omitempty"`
+}
+
+// jobstate is scheduled job of port.
+type jobstate struct {
+	port  string
+	job   job
+	sched *cronschedule
+	// stop is closed when job is removed or changed.
+	stop chan struct{}
+	mu   sync.Mutex
+	next time.Time
+}
+
+// jobstatus is job with its state, returned by jobs API.
+type jobstatus struct {
+	job
+	Next    time.Time `json:"next"`
+	Running bool      `json:"running"`
+	Last    *jobrun   `json:"last,omitempty"`
+}
+
+// scheduler keeps scheduled jobs by port and job name. Running and last
+// run are kept apart, so they survive change of job.
+var scheduler = struct {
+	mu      sync.Mutex
+	jobs    map[string]*jobstate
+	running map[string]bool
+	last    map[string]*jobrun
+	stopped bool
+}{jobs: make(map[string]*jobstate), running: make(map[string]bool), last: make(map[string]*jobrun)}
+
+// jobhistory is logger of run history, recreated when logs config changes.
+var jobhistory = struct {
+	mu sync.Mutex
+	l  *lumberjack.Logger
+}{}
+
+func jobkey(pn string, name string) string {
+	return pn + "\x00" + name
+}
+
+// syncjobs will start, stop and restart scheduled jobs as per config. It
+// is called on start, reload and every change of ports or jobs.
+func syncjobs() {
+	want := make(map[string]*jobstate)
+	config.mu.Lock()
+	for _, pc := range config.Ports {
+		for _, j := range pc.Jobs {
+			want[jobkey(pc.Name, j.Name)] = &jobstate{port: pc.Name, job: j}
+		}
+	}
+	config.mu.Unlock()
+
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	if scheduler.stopped {
+		return
+	}
+	for key, js := range scheduler.jobs {
+		if w, got := want[key]; !got || !reflect.DeepEqual(w.job, js.job) {
+			close(js.stop)
+			delete(scheduler.jobs, key)
+		}
+	}
+	for key, js := range want {
+		if _, got := scheduler.jobs[key]; got {
+			continue
+		}
+		sched, err := parsecron(js.job.Schedule)
+		if err != nil {
+			log.Printf("Port:%s job %s not scheduled: %s", js.port, js.job.Name, err)
+			continue
+		}
+		js.sched = sched
+		js.stop = make(chan struct{})
+		scheduler.jobs[key] = js
+		go js.loop()
+	}
+}
+
+// stopjobs will stop scheduling on shutdown, running jobs end with their
+// sessions.
+func stopjobs() {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	scheduler.stopped = true
+	for key, js := range scheduler.jobs {
+		close(js.stop)
+		delete(scheduler.jobs, key)
+	}
+}
+
+// getjob will return scheduled job of port or nil.
+func getjob(pn string, name string) *jobstate {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	return scheduler.jobs[jobkey(pn, name)]
+}
+
+// loop will start run of job on every scheduled time till job is stopped.
+func (js *jobstate) loop() {
+	var prev time.Time
+	for {
+		// timer may fire early by clock adjustment, never run same minute twice.
+		from := time.Now()
+		if from.Before(prev) {
+			from = prev
+		}
+		next := js.sched.next(from)
+		if next.IsZero() {
+			return
+		}
+		js.mu.Lock()
+		js.next = next
+		js.mu.Unlock()
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+			prev = next
+			go js.run("schedule", "scheduler", js.job.Name)
+		case <-js.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// run will run job once with session of given client and user and record
+// it in history.
+func (js *jobstate) run(trigger string, raddr string, user string) {
+	key := jobkey(js.port, js.job.Name)
+	run := jobrun{Port: js.port, Job: js.job.Name, Trigger: trigger, Start: time.Now().UTC()}
+	skip := func(reason string) {
+		run.End = time.Now().UTC()
+		run.Status = jobSkipped
+		run.Error = reason
+		recordjob(run)
+	}
+	scheduler.mu.Lock()
+	busy := scheduler.running[key]
+	scheduler.running[key] = true
+	scheduler.mu.Unlock()
+	if busy {
+		skip("previous run is still running")
+		return
+	}
+	defer func() {
+		scheduler.mu.Lock()
+		delete(scheduler.running, key)
+		scheduler.mu.Unlock()
+	}()
+
+	all.mu.Lock()
+	sp, got := all.ports[js.port]
+	open := got && sp.status == 1 && sp.port != nil
+	all.mu.Unlock()
+	if !open {
+		skip("port is disabled or not yet opened")
+		return
+	}
+	s := sp.clientactive.attach(raddr, user, "job")
+	defer sp.clientactive.detach(s)
+	if !sp.clientactive.trywrite(s) {
+		if js.job.Busy != busyQueue {
+			skip("port is held by writer " + sp.clientactive.getraaddr())
+			return
+		}
+		log.Printf("Port:%s job %s queued, port is held by writer %s", js.port, js.job.Name,
+			sp.clientactive.getraaddr())
+		if err := js.queue(sp, s); err != nil {
+			skip(err.Error())
+			return
+		}
+	}
+	auditsession(s, js.port, "session.start")
+	defer auditsession(s, js.port, "session.end")
+	sub, _ := sp.comm.subscribe()
+	defer sp.comm.unsubscribe(sub)
+
+	sc := js.job.Script
+	if sc.Name == "" {
+		sc.Name = js.job.Name
+	}
+	log.Printf("Port:%s job %s started by %s", js.port, js.job.Name, trigger)
+	sp.capture.marker("job "+js.job.Name+" started by "+trigger, time.Now())
+	res := runscript(context.Background(), sp, s, sub, &sc, &transcript{w: ioutil.Discard, flush: func() {}})
+	msg := "job " + js.job.Name + " " + res.Status
+	if res.Error != "" {
+		msg = msg + ": " + res.Error
+	}
+	sp.capture.marker(msg, time.Now())
+
+	run.Start, run.End = res.Start, res.End
+	run.Status, run.Error, run.Vars = res.Status, res.Error, res.Vars
+	output := res.output
+	if len(output) > maxjoboutput {
+		output = output[:maxjoboutput]
+		run.Truncated = true
+	}
+	if len(output) > 0 {
+		name, err := saveoutput(jobrunsdir, js.port, js.job.Name, run.Start, output)
+		if err != nil {
+			log.Printf("Port:%s job %s output not saved: %s", js.port, js.job.Name, err)
+		}
+		run.Output = name
+	}
+	if js.job.Artifact != "" && res.Status == scriptOk {
+		name, err := saveartifact(js.port, js.job.Artifact, run.Start, res.output)
+		if err != nil {
+			log.Printf("Port:%s job %s artifact not saved: %s", js.port, js.job.Name, err)
+		}
+		run.Artifact = name
+	}
+	recordjob(run)
+}
+
+// queue will wait for write role requested from current writer till next
+// scheduled run of job.
+func (js *jobstate) queue(sp *serialport, s *session) error {
+	sp.clientactive.requestwrite(s, false)
+	timer := time.NewTimer(time.Until(js.sched.next(time.Now())))
+	defer timer.Stop()
+	for !sp.clientactive.iswriter(s) {
+		select {
+		case <-s.events:
+			// role changes are notified to every session.
+		case reason := <-s.closed:
+			return errors.New("session closed: " + reason)
+		case <-js.stop:
+			return errors.New("job was changed while waiting for port")
+		case <-timer.C:
+			return errors.New("port was held by writer till next run")
+		}
+	}
+	return nil
+}
+
+// saveartifact will store output of run in artifacts dir under logs dir and
+// return its path under /logs/.
+func saveartifact(pn string, artifact string, t time.Time, data []byte) (string, error) {
+	return saveoutput(artifactsdir, pn, artifact, t, data)
+}
+
+// saveoutput will store output of run in given dir under logs dir and
+// return its path under /logs/. File name starts with log name of port so
+// it needs viewer role on port like port logs. Outputs of runs older than
+// logs maxage are removed, artifacts are kept.
+func saveoutput(subdir string, pn string, name string, t time.Time, data []byte) (string, error) {
+	config.mu.Lock()
+	dir := config.Logs.Inlogs + subdir
+	maxage := config.Logs.Maxage
+	config.mu.Unlock()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	fname := logname(pn) + "-" + name + "-" + t.UTC().Format("20060102T150405Z") + ".txt"
+	if err := ioutil.WriteFile(dir+fname, data, 0644); err != nil {
+		return "", err
+	}
+	if subdir == jobrunsdir && maxage > 0 {
+		removeold(dir, time.Now().AddDate(0, 0, -maxage))
+	}
+	return subdir + fname, nil
+}
+
+// removeold will remove files of dir modified before given time.
+func removeold(dir string, before time.Time) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, f := range files {
+		if f.Mode().IsRegular() && f.ModTime().Before(before) {
+			if err := os.Remove(dir + f.Name()); err != nil {
+				log.Printf("Error removing old job output: %s", err)
+			}
+		}
+	}
+}
+
+// recordjob will keep run as last run of job and append it to history.
+func recordjob(run jobrun) {
+	log.Printf("Port:%s job %s %s %s", run.Port, run.Job, run.Status, run.Error)
+	scheduler.mu.Lock()
+	scheduler.last[jobkey(run.Port, run.Job)] = &run
+	scheduler.mu.Unlock()
+	b, err := json.Marshal(run)
+	if err != nil {
+		return
+	}
+	jobhistory.mu.Lock()
+	defer jobhistory.mu.Unlock()
+	if _, err = historylogger().Write(append(b, '\n')); err != nil {
+		log.Printf("Error writing job history: %s", err)
+	}
+}
+
+// historylogger will return logger of run history as per logs config,
+// caller holds jobhistory.mu.
+func historylogger() *lumberjack.Logger {
+	config.mu.Lock()
+	l := &lumberjack.Logger{Filename: config.Logs.Inlogs + jobhistoryfile,
+		MaxSize: config.Logs.Maxsize, MaxAge: config.Logs.Maxage, MaxBackups: config.Logs.Maxbackups}
+	config.mu.Unlock()
+	old := jobhistory.l
+	if old != nil && old.Filename == l.Filename && old.MaxSize == l.MaxSize &&
+		old.MaxAge == l.MaxAge && old.MaxBackups == l.MaxBackups {
+		return old
+	}
+	if old != nil {
+		old.Close()
+	}
+	jobhistory.l = l
+	return l
+}
+
+// getJobs will return jobs of port with next run time and last run.
+func getJobs(w http.ResponseWriter, r *http.Request) {
+	sp, pname := pathport(r)
+	if sp == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Port not found."))
+		return
+	}
+	if !authorize(w, r, pname, roleViewer) {
+		return
+	}
+	pc, _ := config.getElement(pname)
+	list := []jobstatus{}
+	for _, j := range pc.Jobs {
+		st := jobstatus{job: j}
+		if js := getjob(pname, j.Name); js != nil {
+			js.mu.Lock()
+			st.Next = js.next
+			js.mu.Unlock()
+		}
+		scheduler.mu.Lock()
+		st.Running = scheduler.running[jobkey(pname, j.Name)]
+		st.Last = scheduler.last[jobkey(pname, j.Name)]
+		scheduler.mu.Unlock()
+		list = append(list, st)
+	}
+	writejson(w, list)
+}
+
+// setJob will add job posted as JSON to port, or replace job with same
+// name, and write config.
+func setJob(w http.ResponseWriter, r *http.Request) {
+	sp, pname := pathport(r)
+	if sp == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Port not found."))
+		return
+	}
+	if !authorize(w, r, pname, roleAdmin) {
+		return
+	}
+	var j job
+	if err := json.NewDecoder(r.Body).Decode(&j); err != nil {
+		log.Printf("[Client:%s Serial Port:%s]Error in posted JSON decode:%s",
+			r.RemoteAddr, pname, err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid job: " + err.Error()))
+		return
+	}
+	var errs configerrors
+	j.check("job", &errs)
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(errs.Error()))
+		return
+	}
+	before, _ := config.getElement(pname)
+	jobs := []job{}
+	replaced := false
+	for _, value := range before.Jobs {
+		if value.Name == j.Name {
+			value = j
+			replaced = true
+		}
+		jobs = append(jobs, value)
+	}
+	if !replaced {
+		jobs = append(jobs, j)
+	}
+	changejobs(w, r, pname, before, jobs, "job.set")
+}
+
+// deleteJob will remove job of port and write config.
+func deleteJob(w http.ResponseWriter, r *http.Request) {
+	sp, pname := pathport(r)
+	if sp == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Port not found."))
+		return
+	}
+	if !authorize(w, r, pname, roleAdmin) {
+		return
+	}
+	name := mux.Vars(r)["job"]
+	before, _ := config.getElement(pname)
+	jobs := []job{}
+	for _, value := range before.Jobs {
+		if value.Name != name {
+			jobs = append(jobs, value)
+		}
+	}
+	if len(jobs) == len(before.Jobs) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Job not found."))
+		return
+	}
+	changejobs(w, r, pname, before, jobs, "job.delete")
+}
+
+// changejobs will apply new job list of port, write config, reschedule jobs
+// and audit change.
+func changejobs(w http.ResponseWriter, r *http.Request, pname string, before port, jobs []job, action string) {
+	if len(jobs) == 0 {
+		jobs = nil
+	}
+	if err := config.setJobs(pname, jobs); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	syncjobs()
+	after, _ := config.getElement(pname)
+	e := auditentry{Actor: username(r), Raddr: r.RemoteAddr, Action: action, Port: pname,
+		Before: &before, After: &after, Result: "ok"}
+	if err := config.writeYaml(*conf); err != nil {
+		e.Result = "error: " + err.Error()
+		audit(e)
+		configerror(w, r, pname, err)
+		return
+	}
+	audit(e)
+	log.Printf("[Client:%s Serial Port:%s]Jobs of port changed by %s.", r.RemoteAddr, pname, action)
+}
+
+// runJob will start job of port at once, result is recorded in history.
+func runJob(w http.ResponseWriter, r *http.Request) {
+	sp, pname := pathport(r)
+	if sp == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Port not found."))
+		return
+	}
+	if !authorize(w, r, pname, roleOperator) {
+		return
+	}
+	name := mux.Vars(r)["job"]
+	js := getjob(pname, name)
+	if js == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Job not found."))
+		return
+	}
+	scheduler.mu.Lock()
+	running := scheduler.running[jobkey(pname, name)]
+	scheduler.mu.Unlock()
+	if running {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("Job is already running."))
+		return
+	}
+	go js.run("manual by "+username(r)+"@"+r.RemoteAddr, r.RemoteAddr, username(r))
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("Job started."))
+}
+
+// getJobHistory will return runs of job as JSON array, newest last, limit
+// keeps newest runs (default 100). Only current history file is read,
+// rotated ones are served under /logs/ to admins.
+func getJobHistory(w http.ResponseWriter, r *http.Request) {
+	sp, pname := pathport(r)
+	if sp == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Port not found."))
+		return
+	}
+	if !authorize(w, r, pname, roleViewer) {
+		return
+	}
+	name := mux.Vars(r)["job"]
+	limit := 100
+	if v := r.FormValue("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid limit."))
+			return
+		}
+	}
+	config.mu.Lock()
+	fname := config.Logs.Inlogs + jobhistoryfile
+	config.mu.Unlock()
+	runs := []json.RawMessage{}
+	f, err := os.Open(fname)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("[Client:%s]Error opening job history: %s", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error reading job history."))
+		return
+	}
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var run jobrun
+			if json.Unmarshal(scanner.Bytes(), &run) != nil || run.Port != pname || run.Job != name {
+				continue
+			}
+			runs = append(runs, json.RawMessage(append([]byte(nil), scanner.Bytes()...)))
+			if len(runs) > limit {
+				runs = runs[1:]
+			}
+		}
+	}
+	writejson(w, runs)
+}
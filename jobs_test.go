@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSaveoutput(t *testing.T) {
+	dir := t.TempDir() + "/"
+	config.mu.Lock()
+	saved := config.Logs
+	config.Logs.Inlogs = dir
+	config.Logs.Maxage = 7
+	config.mu.Unlock()
+	defer func() {
+		config.mu.Lock()
+		config.Logs = saved
+		config.mu.Unlock()
+	}()
+	if err := os.MkdirAll(dir+jobrunsdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	old := dir + jobrunsdir + "ttyUSB0-backup-20200101T000000Z.txt"
+	if err := ioutil.WriteFile(old, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().AddDate(0, 0, -8)
+	if err := os.Chtimes(old, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	name, err := saveoutput(jobrunsdir, "/dev/ttyUSB0", "backup", start, []byte("router# "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "jobruns/ttyUSB0-backup-20240101T100000Z.txt"; name != want {
+		t.Errorf("name = %s, want %s", name, want)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(b) != "router# " {
+		t.Errorf("output = %q, %v", b, err)
+	}
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("output older than maxage kept: %v", err)
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// export formats of log export.
+const (
+	exportText = "text"
+	exportJSON = "json"
+	exportZip  = "zip"
+)
+
+// time in export file names.
+const exportfiletime = "20060102T150405Z"
+
+// exportmeta is metadata header of log export. Untimed are files whose
+// lines carry no time (raw format), they are exported whole along with
+// timed files, export with untimed files only is refused.
+type exportmeta struct {
+	Port     string    `json:"port"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Exported time.Time `json:"exported"`
+	User     string    `json:"user,omitempty"`
+	Files    []string  `json:"files"`
+	Untimed  []string  `json:"untimed,omitempty"`
+	// Lines is number of exported lines, known only in zip metadata.json.
+	Lines int `json:"lines,omitempty"`
+}
+
+// text will return metadata as # comment lines.
+func (m *exportmeta) text() string {
+	lines := []string{
+		"port: " + m.Port,
+		"from: " + m.From.Format(capturetime),
+		"to: " + m.To.Format(capturetime),
+		"exported: " + m.Exported.Format(capturetime),
+	}
+	if m.User != "" {
+		lines = append(lines, "user: "+m.User)
+	}
+	lines = append(lines, "files: "+strings.Join(m.Files, ", "))
+	if len(m.Untimed) > 0 {
+		lines = append(lines, "untimed: "+strings.Join(m.Untimed, ", ")+" (no line times, exported whole)")
+	}
+	return "# " + strings.Join(lines, "\n# ") + "\n"
+}
+
+// timedfile will return true if first line of log file has time, logs
+// format of port can only change with restart of port which starts on
+// new line, so first line tells format of rest of file well enough.
+func timedfile(dir string, lf logfile) bool {
+	rc, err := lf.open(dir)
+	if err != nil {
+		return false
+	}
+	defer rc.Close()
+	line, _ := bufio.NewReaderSize(rc, 4096).ReadBytes('\n')
+	if len(line) == 0 {
+		return true
+	}
+	_, _, got := linetime(line)
+	return got
+}
+
+// timedline will convert line of timestamp or raw format to capture record.
+func timedline(line []byte, t time.Time) captureline {
+	c := captureline{Dir: dirRx}
+	if !t.IsZero() {
+		c.Time = t.Format(capturetime)
+		if index := bytes.IndexByte(line, ' '); index >= 0 {
+			line = line[index+1:]
+		}
+	}
+	text := string(line)
+	switch {
+	case strings.HasPrefix(text, inputmark+"["):
+		c.Dir = dirTx
+		text = strings.TrimSuffix(strings.TrimPrefix(text, inputmark+"["), "\n")
+		if index := strings.Index(text, "] "); index >= 0 {
+			c.Session, text = text[:index], text[index+2:]
+		}
+		c.Redacted = text == redacted
+	case strings.HasPrefix(text, markermark):
+		c.Dir = dirMarker
+		text = strings.TrimSuffix(strings.TrimPrefix(text, markermark), "\n")
+	}
+	c.Data = text
+	return c
+}
+
+// logexport will write lines of port logs logged between from and to.
+type logexport struct {
+	from   time.Time
+	to     time.Time
+	format string
+	w      io.Writer
+	// text writes json records in timestamp format.
+	text  *capturelog
+	lines int
+}
+
+// line will write one log line, t is its time or zero for raw line.
+func (e *logexport) line(line []byte, t time.Time) {
+	e.lines++
+	if line[0] == '{' && !t.IsZero() {
+		var c captureline
+		if json.Unmarshal(line, &c) == nil {
+			if e.format == exportJSON {
+				e.w.Write(line)
+				return
+			}
+			switch c.Dir {
+			case dirTx:
+				e.text.writeinput(c.Session, &inputline{buf: []byte(c.Data), time: t, secret: c.Redacted})
+			case dirMarker:
+				e.text.marker(c.Data, t)
+			default:
+				e.text.record(c.Dir, []byte(c.Data), t)
+			}
+			return
+		}
+	}
+	if e.format == exportJSON {
+		b, err := json.Marshal(timedline(line, t))
+		if err == nil {
+			e.w.Write(append(b, '\n'))
+		}
+		return
+	}
+	e.text.ensureline()
+	e.w.Write(line)
+	if line[len(line)-1] != '\n' {
+		e.w.Write([]byte("\n"))
+	}
+}
+
+// file will export lines of one file, returns false once lines after to
+// are reached. Lines without time take time of line before them, lines
+// of untimed file are all exported.
+func (e *logexport) file(dir string, lf logfile, timed bool) (bool, error) {
+	rc, err := lf.open(dir)
+	if err != nil {
+		return true, err
+	}
+	defer rc.Close()
+	reader := bufio.NewReaderSize(rc, 64*1024)
+	// First lines may continue line of previous file.
+	last := lf.from
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			t, _, got := linetime(line)
+			if got {
+				last = t
+			}
+			switch {
+			case !timed:
+				e.line(line, time.Time{})
+			case last.After(e.to):
+				return false, nil
+			case !last.Before(e.from):
+				e.line(line, t)
+			}
+		}
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return true, err
+		}
+	}
+}
+
+// exportLogs will return lines of current and rotated capture logs of port
+// logged between from and to (RFC 3339), as text (default), JSON lines
+// with format=json or zip of text and metadata.json with format=zip.
+// Metadata header comes first, as # lines in text and as first JSON line.
+func exportLogs(w http.ResponseWriter, r *http.Request) {
+	pname := r.FormValue("port")
+	// Authorized first, so that existence of port is not told to others.
+	if !authorize(w, r, pname, roleViewer) {
+		return
+	}
+	if !config.checkElement(pname) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Port not found."))
+		return
+	}
+	e := &logexport{format: r.FormValue("format")}
+	if e.format == "" {
+		e.format = exportText
+	}
+	if e.format != exportText && e.format != exportJSON && e.format != exportZip {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid format, use text, json or zip."))
+		return
+	}
+	var err error
+	if e.from, err = time.Parse(time.RFC3339, r.FormValue("from")); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid from time, use RFC 3339 format."))
+		return
+	}
+	if e.to, err = time.Parse(time.RFC3339, r.FormValue("to")); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid to time, use RFC 3339 format."))
+		return
+	}
+	if !e.from.Before(e.to) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("from must be before to."))
+		return
+	}
+
+	config.mu.Lock()
+	dir := config.Logs.Inlogs
+	config.mu.Unlock()
+	list, err := logfiles(dir, pname)
+	if err != nil {
+		log.Printf("[Client:%s Serial Port:%s]Error listing logs: %s", r.RemoteAddr, pname, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error reading logs."))
+		return
+	}
+	meta := &exportmeta{Port: pname, From: e.from.UTC(), To: e.to.UTC(),
+		Exported: time.Now().UTC(), User: username(r), Files: []string{}}
+	var files []logfile
+	timed := make(map[string]bool)
+	for _, lf := range list {
+		if !lf.overlaps(e.from, e.to) {
+			continue
+		}
+		files = append(files, lf)
+		meta.Files = append(meta.Files, lf.name)
+		timed[lf.name] = timedfile(dir, lf)
+		if !timed[lf.name] {
+			meta.Untimed = append(meta.Untimed, lf.name)
+		}
+	}
+
+	if len(files) > 0 && len(meta.Untimed) == len(files) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("Logs of port in this time range have no line times (raw logformat), they can not be " +
+			"exported by time. Set logformat timestamp or json for port, or download files from /logs/: " +
+			strings.Join(meta.Untimed, ", ")))
+		return
+	}
+
+	name := logname(pname) + "-" + meta.From.Format(exportfiletime) + "-" + meta.To.Format(exportfiletime)
+	var zw *zip.Writer
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	switch e.format {
+	case exportJSON:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.jsonl"`)
+		e.w = w
+		b, _ := json.Marshal(meta)
+		w.Write(append(b, '\n'))
+	case exportZip:
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.zip"`)
+		zw = zip.NewWriter(w)
+		if e.w, err = zw.CreateHeader(&zip.FileHeader{Name: name + ".txt", Method: zip.Deflate,
+			Modified: meta.Exported}); err != nil {
+			return
+		}
+		e.w.Write([]byte(meta.text()))
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.txt"`)
+		e.w = w
+		w.Write([]byte(meta.text()))
+	}
+	e.text = newcapturelog(e.w, logTimestamp, false)
+
+	for _, lf := range files {
+		more, err := e.file(dir, lf, timed[lf.name])
+		if err != nil {
+			// Response is already started, other files are still exported.
+			log.Printf("[Client:%s Serial Port:%s]Error exporting %s: %s", r.RemoteAddr, pname, lf.name, err)
+		}
+		if !more || r.Context().Err() != nil {
+			break
+		}
+	}
+	e.text.ensureline()
+	if zw != nil {
+		meta.Lines = e.lines
+		if mw, err := zw.CreateHeader(&zip.FileHeader{Name: "metadata.json", Method: zip.Deflate,
+			Modified: meta.Exported}); err == nil {
+			b, _ := json.MarshalIndent(meta, "", "  ")
+			mw.Write(append(b, '\n'))
+		}
+		if err := zw.Close(); err != nil {
+			log.Printf("[Client:%s Serial Port:%s]Error writing export zip: %s", r.RemoteAddr, pname, err)
+		}
+	}
+	log.Printf("[Client:%s Serial Port:%s]Exported %d log lines from %s to %s as %s.", r.RemoteAddr,
+		pname, e.lines, meta.From.Format(time.RFC3339), meta.To.Format(time.RFC3339), e.format)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// export will run log export with query and return response.
+func export(query string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	exportLogs(w, httptest.NewRequest("GET", "/logs/export?port=/dev/ttyUSB0&"+query, nil))
+	return w
+}
+
+// withoutheader will return export text without # metadata lines.
+func withoutheader(text string) string {
+	var lines []string
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if !strings.HasPrefix(line, "# ") {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+func TestExportText(t *testing.T) {
+	logstest(t)
+	w := export("from=2024-01-01T09:45:00Z&to=2024-01-01T10:50:00Z")
+	if w.Code != http.StatusOK {
+		t.Fatalf("export = %d %s", w.Code, w.Body)
+	}
+	body := w.Body.String()
+	// Lines are cut at both ends of range, continuation line goes with its line.
+	want := "2024-01-01T09:59:00.000Z link up\n2024-01-01T10:15:00.000Z link down\n continued\n" +
+		"2024-01-01T10:45:00.000Z idle\n"
+	if got := withoutheader(body); got != want {
+		t.Errorf("export = %q, want %q", got, want)
+	}
+	if !strings.HasPrefix(body, "# port: /dev/ttyUSB0\n# from: 2024-01-01T09:45:00.000Z\n") ||
+		!strings.Contains(body, "# files: ttyUSB0-2024-01-01T10-00-00.000.txt.gz, ttyUSB0-2024-01-01T11-00-00.000.txt\n") {
+		t.Errorf("export header = %q", body)
+	}
+	if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="ttyUSB0-20240101T094500Z-20240101T105000Z.txt"` {
+		t.Errorf("Content-Disposition = %s", got)
+	}
+
+	// JSON records of current file are written in timestamp format.
+	w = export("from=2024-01-01T11:00:00Z&to=2024-01-01T12:00:00Z")
+	want = "2024-01-01T11:30:00.000Z link down again\n2024-01-01T11:31:00.000Z >>> [alice] show link\n"
+	if got := withoutheader(w.Body.String()); got != want {
+		t.Errorf("export of json records = %q, want %q", got, want)
+	}
+}
+
+func TestExportJSON(t *testing.T) {
+	logstest(t)
+	w := export("format=json&from=2024-01-01T10:40:00Z&to=2024-01-01T11:30:00Z")
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	if w.Code != http.StatusOK || len(lines) != 3 {
+		t.Fatalf("export = %d %q", w.Code, lines)
+	}
+	var meta exportmeta
+	if err := json.Unmarshal([]byte(lines[0]), &meta); err != nil || meta.Port != "/dev/ttyUSB0" ||
+		len(meta.Files) != 2 {
+		t.Errorf("metadata = %+v, %v", meta, err)
+	}
+	if want := `{"time":"2024-01-01T10:45:00.000Z","dir":"rx","data":"idle\n"}`; lines[1] != want {
+		t.Errorf("converted line = %s, want %s", lines[1], want)
+	}
+	if want := `{"time":"2024-01-01T11:30:00.000Z","dir":"rx","data":"link down again\n"}`; lines[2] != want {
+		t.Errorf("json line = %s, want %s", lines[2], want)
+	}
+}
+
+func TestExportZip(t *testing.T) {
+	logstest(t)
+	w := export("format=zip&from=2024-01-01T09:00:00Z&to=2024-01-01T09:30:00Z")
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("export is not zip: %s", err)
+	}
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		files[f.Name] = string(b)
+	}
+	text := files["ttyUSB0-20240101T090000Z-20240101T093000Z.txt"]
+	if want := "2024-01-01T09:00:00.000Z boot ok\n2024-01-01T09:30:00.000Z link down\n"; withoutheader(text) != want {
+		t.Errorf("zip text = %q, want %q", text, want)
+	}
+	var meta exportmeta
+	if err := json.Unmarshal([]byte(files["metadata.json"]), &meta); err != nil || meta.Lines != 2 {
+		t.Errorf("zip metadata = %+v, %v", meta, err)
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	logstest(t)
+	for query, want := range map[string]int{
+		"from=2024-01-01T09:00:00Z":                                    http.StatusBadRequest,
+		"from=2024-01-01T10:00:00Z&to=2024-01-01T09:00:00Z":            http.StatusBadRequest,
+		"from=2024-01-01T09:00:00Z&to=2024-01-01T10:00:00Z&format=pdf": http.StatusBadRequest,
+		"from=2023-01-01T00:00:00Z&to=2023-01-02T00:00:00Z":            http.StatusOK,
+	} {
+		if w := export(query); w.Code != want {
+			t.Errorf("export %s = %d, want %d", query, w.Code, want)
+		}
+	}
+	w := httptest.NewRecorder()
+	exportLogs(w, httptest.NewRequest("GET", "/logs/export?port=/dev/ttyUSB9&from=2024-01-01T09:00:00Z&to=2024-01-01T10:00:00Z", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("export of unknown port = %d", w.Code)
+	}
+
+	config.mu.Lock()
+	saved := config.Auth.Enable
+	config.Auth.Enable = 1
+	config.mu.Unlock()
+	defer func() {
+		config.mu.Lock()
+		config.Auth.Enable = saved
+		config.mu.Unlock()
+	}()
+	w = httptest.NewRecorder()
+	exportLogs(w, httptest.NewRequest("GET", "/logs/export?port=/dev/ttyUSB9&from=2024-01-01T09:00:00Z&to=2024-01-01T10:00:00Z", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("export of unknown port without role = %d, want 403", w.Code)
+	}
+}
+
+func TestExportUntimed(t *testing.T) {
+	dir := logstest(t)
+	if err := ioutil.WriteFile(dir+"ttyUSB0.txt", []byte("raw link down\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Only current file is in range and its lines have no time.
+	w := export("from=2024-01-01T11:00:01Z&to=2099-01-01T00:00:00Z")
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "ttyUSB0.txt") {
+		t.Errorf("export of untimed file = %d %s", w.Code, w.Body)
+	}
+	// Untimed file along with timed one is exported whole.
+	w = export("from=2024-01-01T10:40:00Z&to=2099-01-01T00:00:00Z")
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.HasSuffix(body, "2024-01-01T10:45:00.000Z idle\nraw link down\n") ||
+		!strings.Contains(body, "# untimed: ttyUSB0.txt") {
+		t.Errorf("export with untimed file = %d %q", w.Code, body)
+	}
+}
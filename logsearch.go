@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// time in file name of rotated log, lumberjack writes it in UTC.
+const rotatedtime = "2006-01-02T15-04-05.000"
+
+// search limits, line longer than capturemaxline is cut in results.
+const (
+	defaultSearchContext = 2
+	maxSearchContext     = 100
+	defaultSearchLimit   = 1000
+)
+
+// logfile is current or rotated capture log of port. Data in it was
+// written after from (zero if unknown) and till to.
+type logfile struct {
+	name string
+	gz   bool
+	from time.Time
+	to   time.Time
+}
+
+// overlaps will return true if file may have data between from and to,
+// zero time is open end.
+func (lf logfile) overlaps(from time.Time, to time.Time) bool {
+	if !from.IsZero() && lf.to.Before(from) {
+		return false
+	}
+	if !to.IsZero() && !lf.from.IsZero() && lf.from.After(to) {
+		return false
+	}
+	return true
+}
+
+// open will return reader of uncompressed file data.
+func (lf logfile) open(dir string) (io.ReadCloser, error) {
+	f, err := os.Open(dir + lf.name)
+	if err != nil {
+		return nil, err
+	}
+	if !lf.gz {
+		return f, nil
+	}
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{z, f}, nil
+}
+
+// logfiles will return current and rotated capture logs of port in logs
+// dir, oldest first.
+func logfiles(dir string, pn string) ([]logfile, error) {
+	name := logname(pn)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var list []logfile
+	var current *logfile
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
+		}
+		base := fi.Name()
+		if base == name+".txt" {
+			current = &logfile{name: base, to: fi.ModTime()}
+			continue
+		}
+		lf := logfile{name: base}
+		rest := strings.TrimPrefix(base, name+"-")
+		if rest == base {
+			continue
+		}
+		if strings.HasSuffix(rest, ".txt.gz") {
+			lf.gz = true
+			rest = strings.TrimSuffix(rest, ".txt.gz")
+		} else if strings.HasSuffix(rest, ".txt") {
+			rest = strings.TrimSuffix(rest, ".txt")
+		} else {
+			continue
+		}
+		// Other port may have name starting with name of this one.
+		t, err := time.ParseInLocation(rotatedtime, rest, time.UTC)
+		if err != nil {
+			continue
+		}
+		lf.to = t
+		list = append(list, lf)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].to.Before(list[j].to) })
+	if current != nil {
+		list = append(list, *current)
+	}
+	// File has data written after previous one was rotated.
+	for index := 1; index < len(list); index++ {
+		list[index].from = list[index-1].to
+	}
+	return list, nil
+}
+
+// linetime will return time of capture log line in timestamp or json
+// format and data of line without time, raw line has no time.
+func linetime(line []byte) (time.Time, []byte, bool) {
+	if len(line) > 0 && line[0] == '{' {
+		var c captureline
+		if json.Unmarshal(line, &c) == nil && c.Time != "" {
+			if t, err := time.Parse(time.RFC3339Nano, c.Time); err == nil {
+				return t, []byte(c.Data), true
+			}
+		}
+		return time.Time{}, line, false
+	}
+	index := bytes.IndexByte(line, ' ')
+	if index < 20 || index > 40 {
+		return time.Time{}, line, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, string(line[:index]))
+	if err != nil {
+		return time.Time{}, line, false
+	}
+	return t, line[index+1:], true
+}
+
+// searchmatch is single result of log search, offset is byte offset of
+// line in uncompressed file data.
+type searchmatch struct {
+	File   string     `json:"file"`
+	Offset int64      `json:"offset"`
+	Line   int        `json:"line"`
+	Time   *time.Time `json:"time,omitempty"`
+	Before []string   `json:"before"`
+	Match  string     `json:"match"`
+	After  []string   `json:"after"`
+}
+
+// logsearch is search of capture logs of port, matches are written as JSON
+// lines once their after context is complete.
+type logsearch struct {
+	match   func(data []byte) bool
+	from    time.Time
+	to      time.Time
+	context int
+	limit   int
+	found   int
+	enc     *json.Encoder
+	flush   func()
+}
+
+// cutline will return line without line end, cut to capturemaxline.
+func cutline(line []byte) string {
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) > capturemaxline {
+		line = line[:capturemaxline]
+	}
+	return string(line)
+}
+
+// file will search one log file, returns false once limit is reached.
+func (s *logsearch) file(dir string, lf logfile) (bool, error) {
+	rc, err := lf.open(dir)
+	if err != nil {
+		return true, err
+	}
+	defer rc.Close()
+	reader := bufio.NewReaderSize(rc, 64*1024)
+	var before []string
+	var pending []*searchmatch
+	var last time.Time
+	var offset int64
+	number := 0
+	emit := func(m *searchmatch) bool {
+		s.enc.Encode(m)
+		s.found++
+		return s.found < s.limit
+	}
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			number++
+			text := cutline(line)
+			t, data, got := linetime(line)
+			if got {
+				last = t
+			}
+			// Untimed lines like continuation of raw output take time of
+			// previous timed line.
+			inrange := last.IsZero() || ((s.from.IsZero() || !last.Before(s.from)) &&
+				(s.to.IsZero() || !last.After(s.to)))
+			for len(pending) > 0 && len(pending[0].After) >= s.context {
+				if !emit(pending[0]) {
+					return false, nil
+				}
+				pending = pending[1:]
+			}
+			for _, m := range pending {
+				m.After = append(m.After, text)
+			}
+			if inrange && s.match(data) {
+				m := &searchmatch{File: lf.name, Offset: offset, Line: number,
+					Before: append([]string{}, before...), Match: text, After: []string{}}
+				if !last.IsZero() {
+					t := last
+					m.Time = &t
+				}
+				pending = append(pending, m)
+			}
+			before = append(before, text)
+			if len(before) > s.context {
+				before = before[1:]
+			}
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return true, err
+		}
+	}
+	for _, m := range pending {
+		if !emit(m) {
+			return false, nil
+		}
+	}
+	s.flush()
+	return true, nil
+}
+
+// searchLogs will search current and rotated capture logs of port for q,
+// as plain text or with regex=1 as regular expression. from and to (RFC
+// 3339) limit search to lines logged in between, context is number of
+// lines around match (default 2) and limit is number of matches (default
+// 1000). Matches are streamed as JSON lines, oldest first.
+func searchLogs(w http.ResponseWriter, r *http.Request) {
+	pname := r.FormValue("port")
+	// Authorized first, so that existence of port is not told to others.
+	if !authorize(w, r, pname, roleViewer) {
+		return
+	}
+	if !config.checkElement(pname) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Port not found."))
+		return
+	}
+	q := r.FormValue("q")
+	if q == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Search text q is missing."))
+		return
+	}
+	s := &logsearch{context: defaultSearchContext, limit: defaultSearchLimit, flush: func() {}}
+	if r.FormValue("regex") == "1" || r.FormValue("regex") == "true" {
+		re, err := regexp.Compile(q)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid regex: " + err.Error()))
+			return
+		}
+		s.match = re.Match
+	} else {
+		s.match = func(data []byte) bool { return bytes.Contains(data, []byte(q)) }
+	}
+	var err error
+	if v := r.FormValue("from"); v != "" {
+		if s.from, err = time.Parse(time.RFC3339, v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid from time, use RFC 3339 format."))
+			return
+		}
+	}
+	if v := r.FormValue("to"); v != "" {
+		if s.to, err = time.Parse(time.RFC3339, v); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid to time, use RFC 3339 format."))
+			return
+		}
+	}
+	if v := r.FormValue("context"); v != "" {
+		if s.context, err = strconv.Atoi(v); err != nil || s.context < 0 || s.context > maxSearchContext {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid context, use 0 to " + strconv.Itoa(maxSearchContext) + "."))
+			return
+		}
+	}
+	if v := r.FormValue("limit"); v != "" {
+		if s.limit, err = strconv.Atoi(v); err != nil || s.limit <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid limit."))
+			return
+		}
+	}
+
+	config.mu.Lock()
+	dir := config.Logs.Inlogs
+	config.mu.Unlock()
+	files, err := logfiles(dir, pname)
+	if err != nil {
+		log.Printf("[Client:%s Serial Port:%s]Error listing logs: %s", r.RemoteAddr, pname, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error reading logs."))
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	s.enc = json.NewEncoder(w)
+	if f, ok := w.(http.Flusher); ok {
+		s.flush = f.Flush
+	}
+	for _, lf := range files {
+		if !lf.overlaps(s.from, s.to) {
+			continue
+		}
+		more, err := s.file(dir, lf)
+		if err != nil {
+			// Response is already started, other files are still searched.
+			log.Printf("[Client:%s Serial Port:%s]Error searching %s: %s", r.RemoteAddr, pname, lf.name, err)
+		}
+		if !more || r.Context().Err() != nil {
+			break
+		}
+	}
+	s.flush()
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// logstest will write capture logs of port /dev/ttyUSB0 into temp logs dir
+// of running config: gzipped and plain rotated files in timestamp format
+// and current file in json format, along with files of other ports.
+func logstest(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir() + "/"
+	files := map[string]string{
+		"ttyUSB0-2024-01-01T10-00-00.000.txt.gz": "2024-01-01T09:00:00.000Z boot ok\n" +
+			"2024-01-01T09:30:00.000Z link down\n2024-01-01T09:59:00.000Z link up\n",
+		"ttyUSB0-2024-01-01T11-00-00.000.txt": "2024-01-01T10:15:00.000Z link down\n continued\n" +
+			"2024-01-01T10:45:00.000Z idle\n",
+		"ttyUSB0.txt": `{"time":"2024-01-01T11:30:00.000Z","dir":"rx","data":"link down again\n"}` + "\n" +
+			`{"time":"2024-01-01T11:31:00.000Z","dir":"tx","session":"alice","data":"show link"}` + "\n",
+		"ttyUSB0-extra.txt":                      "2024-01-01T10:15:00.000Z link down\n",
+		"ttyUSB0-2024-01-01T08-00-00.000.log":    "2024-01-01T07:15:00.000Z link down\n",
+		"ttyUSB1.txt":                            "2024-01-01T10:15:00.000Z link down\n",
+		"ttyUSB1-2024-01-01T10-00-00.000.txt.gz": "",
+	}
+	for name, data := range files {
+		b := []byte(data)
+		if strings.HasSuffix(name, ".gz") {
+			f, err := os.Create(dir + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			z := gzip.NewWriter(f)
+			z.Write(b)
+			z.Close()
+			f.Close()
+			continue
+		}
+		if err := ioutil.WriteFile(dir+name, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	modtime := time.Date(2024, 1, 1, 11, 31, 0, 0, time.UTC)
+	os.Chtimes(dir+"ttyUSB0.txt", modtime, modtime)
+	config.mu.Lock()
+	ports, logs := config.Ports, config.Logs
+	config.Ports = []port{{Name: "/dev/ttyUSB0"}}
+	config.Logs.Inlogs = dir
+	config.mu.Unlock()
+	t.Cleanup(func() {
+		config.mu.Lock()
+		config.Ports, config.Logs = ports, logs
+		config.mu.Unlock()
+	})
+	return dir
+}
+
+func TestLogfiles(t *testing.T) {
+	dir := logstest(t)
+	list, err := logfiles(dir, "/dev/ttyUSB0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []logfile{
+		{name: "ttyUSB0-2024-01-01T10-00-00.000.txt.gz", gz: true,
+			to: time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)},
+		{name: "ttyUSB0-2024-01-01T11-00-00.000.txt", from: time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC),
+			to: time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC)},
+		{name: "ttyUSB0.txt", from: time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC),
+			to: time.Date(2024, 1, 1, 11, 31, 0, 0, time.UTC)},
+	}
+	if len(list) != len(want) {
+		t.Fatalf("logfiles = %+v", list)
+	}
+	for index := range want {
+		got := list[index]
+		if got.name != want[index].name || got.gz != want[index].gz || !got.from.Equal(want[index].from) ||
+			!got.to.Equal(want[index].to) {
+			t.Errorf("file %d = %+v, want %+v", index, got, want[index])
+		}
+	}
+	from := time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)
+	if list[0].overlaps(from, time.Time{}) || !list[1].overlaps(from, time.Time{}) ||
+		list[2].overlaps(time.Time{}, from) || !list[0].overlaps(time.Time{}, from) {
+		t.Errorf("overlaps of files with %s is wrong", from)
+	}
+}
+
+func TestLinetime(t *testing.T) {
+	for line, want := range map[string]string{
+		"2024-01-01T09:30:00.123+02:00 link down\n":                              "link down\n",
+		`{"time":"2024-01-01T09:30:00.123+02:00","dir":"rx","data":"link down"}`: "link down",
+	} {
+		got, data, ok := linetime([]byte(line))
+		if !ok || string(data) != want || !got.Equal(time.Date(2024, 1, 1, 7, 30, 0, 123e6, time.UTC)) {
+			t.Errorf("linetime(%q) = %s, %q, %v", line, got, data, ok)
+		}
+	}
+	for _, line := range []string{"link down\n", "2024 link\n", " continued\n", `{"dir":"rx","data":"x"}`,
+		"2024-01-01T09:30:00 link down\n"} {
+		if _, data, ok := linetime([]byte(line)); ok || string(data) != line {
+			t.Errorf("raw line %q has time", line)
+		}
+	}
+}
+
+// search will run log search with query and return status and matches.
+func search(t *testing.T, query string) (int, []searchmatch) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	searchLogs(w, httptest.NewRequest("GET", "/logs/search?"+query, nil))
+	var list []searchmatch
+	scanner := bufio.NewScanner(w.Body)
+	for w.Code == http.StatusOK && scanner.Scan() {
+		var m searchmatch
+		if err := json.Unmarshal(scanner.Bytes(), &m); err != nil {
+			t.Fatalf("match %q: %s", scanner.Text(), err)
+		}
+		list = append(list, m)
+	}
+	return w.Code, list
+}
+
+func TestSearchLogs(t *testing.T) {
+	logstest(t)
+	code, list := search(t, "port=/dev/ttyUSB0&q=link+down&context=1")
+	if code != http.StatusOK || len(list) != 3 {
+		t.Fatalf("search = %d %+v", code, list)
+	}
+	first := list[0]
+	if first.File != "ttyUSB0-2024-01-01T10-00-00.000.txt.gz" || first.Line != 2 || first.Offset != 33 ||
+		first.Match != "2024-01-01T09:30:00.000Z link down" ||
+		strings.Join(first.Before, "|") != "2024-01-01T09:00:00.000Z boot ok" ||
+		strings.Join(first.After, "|") != "2024-01-01T09:59:00.000Z link up" {
+		t.Errorf("first match = %+v", first)
+	}
+	// Context does not cross files.
+	if list[1].Line != 1 || len(list[1].Before) != 0 || strings.Join(list[1].After, "|") != " continued" {
+		t.Errorf("second match = %+v", list[1])
+	}
+	if list[2].File != "ttyUSB0.txt" || list[2].Time == nil ||
+		!list[2].Time.Equal(time.Date(2024, 1, 1, 11, 30, 0, 0, time.UTC)) {
+		t.Errorf("json match = %+v", list[2])
+	}
+
+	// Untimed continuation line takes time of line before it.
+	_, list = search(t, "port=/dev/ttyUSB0&q=continued&from=2024-01-01T10:00:00Z&to=2024-01-01T10:20:00Z")
+	if len(list) != 1 || !list[0].Time.Equal(time.Date(2024, 1, 1, 10, 15, 0, 0, time.UTC)) {
+		t.Errorf("continuation match = %+v", list)
+	}
+	_, list = search(t, "port=/dev/ttyUSB0&q=link+down&from=2024-01-01T10:00:00Z&to=2024-01-01T11:00:00Z")
+	if len(list) != 1 || list[0].File != "ttyUSB0-2024-01-01T11-00-00.000.txt" {
+		t.Errorf("time range matches = %+v", list)
+	}
+	_, list = search(t, "port=/dev/ttyUSB0&q=link+(up|down+again)&regex=1")
+	if len(list) != 2 || list[1].File != "ttyUSB0.txt" {
+		t.Errorf("regex matches = %+v", list)
+	}
+	_, list = search(t, "port=/dev/ttyUSB0&q=link&limit=2&context=0")
+	if len(list) != 2 || len(list[0].Before)+len(list[0].After) != 0 {
+		t.Errorf("limited matches = %+v", list)
+	}
+
+	for query, want := range map[string]int{
+		"port=/dev/ttyUSB1&q=link":              http.StatusNotFound,
+		"port=/dev/ttyUSB0":                     http.StatusBadRequest,
+		"port=/dev/ttyUSB0&q=(&regex=1":         http.StatusBadRequest,
+		"port=/dev/ttyUSB0&q=x&from=yesterday":  http.StatusBadRequest,
+		"port=/dev/ttyUSB0&q=x&context=101":     http.StatusBadRequest,
+		"port=/dev/ttyUSB0&q=x&limit=0":         http.StatusBadRequest,
+		"port=/dev/ttyUSB0&q=nothing+like+this": http.StatusOK,
+	} {
+		if code, _ := search(t, query); code != want {
+			t.Errorf("search %s = %d, want %d", query, code, want)
+		}
+	}
+
+	// Without role unknown and existing port are both forbidden.
+	config.mu.Lock()
+	saved := config.Auth.Enable
+	config.Auth.Enable = 1
+	config.mu.Unlock()
+	defer func() {
+		config.mu.Lock()
+		config.Auth.Enable = saved
+		config.mu.Unlock()
+	}()
+	for _, query := range []string{"port=/dev/ttyUSB1&q=link", "port=/dev/ttyUSB0&q=link"} {
+		if code, _ := search(t, query); code != http.StatusForbidden {
+			t.Errorf("search %s without role = %d, want 403", query, code)
+		}
+	}
+}
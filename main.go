@@ -1,103 +1,160 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
-	"net/http"
-
-	"go.bug.st/serial"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 var (
-	ver    string = "1.3"
-	conf          = flag.String("conf", "", "Configuration file")
-	v             = flag.Bool("version", false, "Get version")
-	all    allports
-	config Config
+	ver       string = "1.3"
+	conf             = flag.String("conf", "", "Configuration file")
+	v                = flag.Bool("version", false, "Get version")
+	hashpw           = flag.Bool("hash-password", false, "Read password from stdin and print bcrypt hash for auth config")
+	watchconf        = flag.Duration("watch-config", 0, "Reload config when file changes, checked at given interval like 2s")
+	checkconf        = flag.Bool("check-config", false, "Validate configuration file, print every problem and exit")
+	all       allports
+	config    Config
+	// agentlogger is closed last on shutdown.
+	agentlogger *lumberjack.Logger
 )
 
 // Open ports and start reader in separate go routine and will be blocked
 // into reader when port is not in error state or will blocked in port
-// opening state when port having error while opening.
+// opening state when port having error while opening. Reader runs till
+// context of port is cancelled by stopreader.
 func initializereader(pn string) {
+	// status is updated under all.mu, so it is read with port lookup.
+	all.mu.Lock()
+	sp, got := all.ports[pn]
+	var status uint8
+	if got {
+		status = sp.status
+	}
+	all.mu.Unlock()
+	if !got {
+		log.Printf("Port:%s not found. Nothing to do.", pn)
+		return
+	}
+	if status != 1 {
+		log.Printf("Port:%s status is disabled. Nothing to do.", pn)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sp.mu.Lock()
+	sp.cancel = cancel
+	sp.mu.Unlock()
+	sp.wg.Add(1)
 	go func(tmpname string) {
-		if all.ports[tmpname].status == 1 {
+		defer func() {
+			log.Printf("Stopped mainreader for port:%s", tmpname)
+			sp.wg.Done()
+		}()
+		retry := openretrymin
+		// only changed open errors are logged, not every retry.
+		var lasterr string
+		for ctx.Err() == nil {
+			if lasterr == "" {
+				log.Printf("Checking port:%s settings:%s", tmpname, sp.line.summary())
+				sp.setstate(stateOpening, nil)
+			}
+			// Subscribed before open, so device event which comes while
+			// open fails is not lost.
+			wake := hotplug.subscribe()
+			// Device is resolved on every attempt, it may move on replug.
+			device, err := sp.devicepath()
+			all.mu.Lock()
+			if err == nil {
+				if device != tmpname {
+					log.Printf("Port:%s resolved to device:%s", tmpname, device)
+				}
+				sp.device = device
+				sp.stats.add(&sp.stats.openattempts, 1)
+				sp.port, err = openserial(device, sp.line)
+			}
+			if err != nil {
+				sp.stats.add(&sp.stats.openerrors, 1)
+				sp.port = nil
+				all.mu.Unlock()
+				if err.Error() != lasterr {
+					log.Printf("Error: %s opening port %s, will retry on device event or after %s.",
+						err, tmpname, retry)
+					lasterr = err.Error()
+				}
+				sp.backoff(err, retry)
+				select {
+				case <-ctx.Done():
+				case <-wake:
+				case <-time.After(retry):
+					retry = nextretry(retry)
+				}
+				hotplug.unsubscribe(wake)
+				continue
+			}
+			p := sp.port
+			all.mu.Unlock()
+			hotplug.unsubscribe(wake)
+			if lasterr != "" {
+				log.Printf("Port:%s opened after device appeared.", tmpname)
+			}
+			retry = openretrymin
+			lasterr = ""
+			sp.setstate(stateOpen, nil)
+			p.SetReadTimeout(time.Second * 3)
+			buf := make([]byte, 1024)
 			for {
-				log.Printf("Checking port:%s", tmpname)
-				var err error
-				var errstate bool
-				if all.ports[tmpname].port == nil {
-					mode := &serial.Mode{
-						BaudRate: all.ports[tmpname].baudrate,
-					}
-					all.mu.Lock()
-					all.ports[tmpname].port, err = serial.Open(tmpname, mode)
-					// all.ports[tmpname].port, err = serial.OpenPort(&serial.Config{Name: tmpname,
-					// 	Baud: all.ports[tmpname].baudrate, ReadTimeout: time.Second * 3})
-					if err == nil {
-						all.mu.Unlock()
-						all.ports[tmpname].port.SetReadTimeout(time.Second * 3)
-						buf := make([]byte, 1024)
-						for {
-							select {
-							case <-all.ports[tmpname].stop:
-								log.Printf("Stopping mainreader for port:%s", tmpname)
-								all.ports[tmpname].ack <- struct{}{}
-								log.Printf("Stop ack send for mainreader port:%s", tmpname)
-								return
-							default:
-								number, err := all.ports[tmpname].port.Read(buf)
-								if err != nil {
-									log.Printf("Main reader having error:%s for port:%s", err, tmpname)
-									all.mu.Lock()
-									all.ports[tmpname].port = nil
-									all.mu.Unlock()
-									errstate = true
-									break
-								}
-								tmpstring := string(buf[:number])
-								_, _ = all.ports[tmpname].infilelogger.Write(buf[:number])
-								select {
-								case all.ports[tmpname].comm <- tmpstring:
-								default:
-								}
-							}
-							if errstate {
-								errstate = false
-								break
-							}
-						}
-					} else {
-						all.ports[tmpname].port = nil
-						all.mu.Unlock()
-						select {
-						case <-all.ports[tmpname].stop:
-							log.Printf("Stopping mainreader for port:%s", tmpname)
-							all.ports[tmpname].ack <- struct{}{}
-							log.Printf("Stop ack send for mainreader port:%s", tmpname)
-							return
-						default:
-							log.Printf("Error: %s opening port %s, will retry after 10Seconds.",
-								err, tmpname)
-							time.Sleep(10 * time.Second)
-						}
-
-					}
+				// stopreader closes port, so blocked read returns at once.
+				number, err := p.Read(buf)
+				if ctx.Err() != nil {
+					break
+				}
+				if err != nil {
+					log.Printf("Main reader having error:%s for port:%s", err, tmpname)
+					sp.stats.add(&sp.stats.readerrors, 1)
+					sp.setstate(stateError, err)
+					break
 				}
+				now := time.Now()
+				sp.stats.add(&sp.stats.readbytes, number)
+				sp.stats.touch(now)
+				sp.capture.record(dirRx, buf[:number], now)
+				// triggers are matched even if no session is attached.
+				for _, ev := range sp.triggers.scan(buf[:number], now) {
+					sp.fire(ev)
+				}
+				sp.comm.publish(buf[:number])
 			}
-		} else {
-			log.Printf("Port:%s status is disabled. Nothing to do.", tmpname)
+			all.mu.Lock()
+			p.Close()
+			sp.port = nil
+			all.mu.Unlock()
 		}
 	}(pn)
 }
 
+// newagentlogger will return logger of agent logs as per logs config.
+func newagentlogger() *lumberjack.Logger {
+	config.mu.Lock()
+	defer config.mu.Unlock()
+	return &lumberjack.Logger{
+		Filename:   config.Logs.Inlogs + "agent.log",
+		MaxSize:    config.Logs.Maxsize,
+		MaxBackups: config.Logs.Maxbackups,
+		MaxAge:     config.Logs.Maxage,
+	}
+}
+
 func initialize() error {
 
 	// Parsing config yaml file to struct
@@ -105,6 +162,7 @@ func initialize() error {
 	if err != nil {
 		return err
 	}
+	configloaded(nil)
 	// Check logs dir exist or not, if not create dir
 	if _, err := os.Stat(config.Logs.Inlogs); os.IsNotExist(err) {
 		log.Printf("Proided logs dir: %s does not exist. Creating it.", config.Logs.Inlogs)
@@ -127,20 +185,21 @@ func initialize() error {
 	}
 
 	// Setting logger for agent logs
-	logger := lumberjack.Logger{
-		Filename:   config.Logs.Inlogs + "agent.log",
-		MaxSize:    config.Logs.Maxsize,
-		MaxBackups: config.Logs.Maxbackups,
-		MaxAge:     config.Logs.Maxage,
+	agentlogger = newagentlogger()
+	log.SetOutput(agentlogger)
+
+	// Audit log of administrative and console actions.
+	if err = openaudit(config.Logs.Inlogs); err != nil {
+		return err
 	}
-	log.SetOutput(&logger)
 
 	// Fill the ports map with appropriate values from yaml config.
 	all.ports = make(map[string]*serialport)
 	for _, value := range config.Ports {
-		all.addnewport(value.Name, value.Baudrate, value.Status)
+		all.addnewport(value)
 	}
 
+	starthotplug()
 	for name := range all.ports {
 		initializereader(name)
 	}
@@ -153,38 +212,60 @@ func main() {
 		fmt.Println(ver)
 		return
 	}
+	if *hashpw {
+		password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Fatalf("Error reading password %s", err)
+		}
+		if err = hashpassword(strings.TrimRight(password, "\r\n")); err != nil {
+			log.Fatalf("Error hashing password %s", err)
+		}
+		return
+	}
+	if *checkconf {
+		if err := config.parseYaml(*conf); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *conf, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: config is valid\n", *conf)
+		return
+	}
 	if err := initialize(); err != nil {
 		log.Fatalf("Error while initiliazing %s", err)
 		return
 	}
-	r := createRouterRegisterPaths()
-	errs := make(chan error)
+	servers.handler = createRouterRegisterPaths()
+	errs := make(chan error, len(config.ServerConfig))
 	for _, value := range config.ServerConfig {
-		if value.Enable == 1 {
-			if value.Name == "http" {
-				go func(port int) {
-					log.Printf("http server starting")
-					err := http.ListenAndServe(":"+strconv.Itoa(port), r)
-					if err != nil {
-						log.Printf("net.http could not listen: %s\n", err)
-						errs <- err
-					}
-				}(value.Port)
-			} else if value.Name == "https" {
-				go func(port int, sslcert string, sslkey string) {
-					log.Printf("https server starting")
-					err := http.ListenAndServeTLS(":"+strconv.Itoa(port), sslcert, sslkey, r)
-					if err != nil {
-						log.Printf("net.https could not listen: %s", err)
-						errs <- err
-					}
-				}(value.Port, value.SslCert, value.SslKey)
-			} else {
-				log.Printf("Unknown protocol %s... Skipping...", value.Name)
-			}
-		} else {
-			log.Printf("Server disabled for protocol:%s", value.Name)
+		startserver(value, errs)
+	}
+	syncjobs()
+	// Every listener is bound by now, ready is not sent if any failed.
+	if len(errs) == 0 {
+		sdnotify("READY=1")
+	}
+	startwatchdog()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadconfig("SIGHUP")
 		}
+	}()
+	if *watchconf > 0 {
+		go watchconfig(*watchconf)
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	code := 0
+	select {
+	case err := <-errs:
+		shutdown(err.Error())
+		code = 1
+	case sig := <-sigs:
+		signal.Stop(sigs)
+		shutdown("received " + sig.String())
 	}
-	<-errs
+	agentlogger.Close()
+	os.Exit(code)
 }
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// portstats holds counters of port for /metrics. They are kept by port
+// name, so they keep counting when port is restarted by stop/start, edit
+// or reload. Fields are updated with atomic and must stay first in struct
+// for 64 bit alignment.
+type portstats struct {
+	readbytes    uint64
+	writtenbytes uint64
+	readerrors   uint64
+	writeerrors  uint64
+	// dropped counts chunks lost by slow sessions in broadcaster.
+	dropped      uint64
+	droppedbytes uint64
+	openattempts uint64
+	openerrors   uint64
+	reconnects   uint64
+	// wserrors and tcperrors count failed writes to clients.
+	wserrors  uint64
+	tcperrors uint64
+	// triggers counts fired triggers, triggererrors failed actions.
+	triggers      uint64
+	triggererrors uint64
+	// lastread is unix nano time of last byte read from port.
+	lastread int64
+}
+
+var stats = struct {
+	mu    sync.Mutex
+	ports map[string]*portstats
+}{ports: make(map[string]*portstats)}
+
+// portstatsof will return counters of given port, created on first use.
+func portstatsof(pn string) *portstats {
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	ps, got := stats.ports[pn]
+	if !got {
+		ps = &portstats{}
+		stats.ports[pn] = ps
+	}
+	return ps
+}
+
+// add will add n to given counter, ps may be nil.
+func (ps *portstats) add(counter *uint64, n int) {
+	if ps != nil {
+		atomic.AddUint64(counter, uint64(n))
+	}
+}
+
+// metric is one metric family of /metrics with value per port.
+type metric struct {
+	name  string
+	kind  string
+	help  string
+	value func(sp *serialport, ps *portstats) uint64
+}
+
+// load will return counter function reading given field.
+func load(field func(ps *portstats) *uint64) func(*serialport, *portstats) uint64 {
+	return func(sp *serialport, ps *portstats) uint64 {
+		return atomic.LoadUint64(field(ps))
+	}
+}
+
+var metrics = []metric{
+	{"spw_port_read_bytes_total", "counter", "Bytes read from serial port.",
+		load(func(ps *portstats) *uint64 { return &ps.readbytes })},
+	{"spw_port_written_bytes_total", "counter", "Bytes written to serial port by sessions.",
+		load(func(ps *portstats) *uint64 { return &ps.writtenbytes })},
+	{"spw_port_read_errors_total", "counter", "Failed reads of serial port.",
+		load(func(ps *portstats) *uint64 { return &ps.readerrors })},
+	{"spw_port_write_errors_total", "counter", "Failed writes to serial port.",
+		load(func(ps *portstats) *uint64 { return &ps.writeerrors })},
+	{"spw_port_dropped_messages_total", "counter", "Chunks of port output dropped for sessions too slow to receive them.",
+		load(func(ps *portstats) *uint64 { return &ps.dropped })},
+	{"spw_port_dropped_bytes_total", "counter", "Bytes of port output dropped for sessions too slow to receive them.",
+		load(func(ps *portstats) *uint64 { return &ps.droppedbytes })},
+	{"spw_port_open_attempts_total", "counter", "Attempts to open serial port.",
+		load(func(ps *portstats) *uint64 { return &ps.openattempts })},
+	{"spw_port_open_errors_total", "counter", "Failed attempts to open serial port.",
+		load(func(ps *portstats) *uint64 { return &ps.openerrors })},
+	{"spw_port_reconnects_total", "counter", "Times serial port was opened again after it was lost.",
+		load(func(ps *portstats) *uint64 { return &ps.reconnects })},
+	{"spw_websocket_write_errors_total", "counter", "Failed writes to websocket clients.",
+		load(func(ps *portstats) *uint64 { return &ps.wserrors })},
+	{"spw_tcp_write_errors_total", "counter", "Failed writes to tcp clients.",
+		load(func(ps *portstats) *uint64 { return &ps.tcperrors })},
+	{"spw_port_triggers_total", "counter", "Times output triggers of port fired.",
+		load(func(ps *portstats) *uint64 { return &ps.triggers })},
+	{"spw_port_trigger_errors_total", "counter", "Failed webhook and command actions of output triggers.",
+		load(func(ps *portstats) *uint64 { return &ps.triggererrors })},
+	{"spw_port_sessions", "gauge", "Active sessions of port.",
+		func(sp *serialport, ps *portstats) uint64 { return uint64(sp.clientactive.getconncount()) }},
+}
+
+// getMetrics will write metrics of ports user can view in Prometheus text
+// exposition format.
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+	all.mu.Lock()
+	var ports []*serialport
+	for _, sp := range all.ports {
+		ports = append(ports, sp)
+	}
+	all.mu.Unlock()
+	var visible []*serialport
+	for _, sp := range ports {
+		if portrole(r, sp.name) >= roleViewer {
+			visible = append(visible, sp)
+		}
+	}
+	sort.Slice(visible, func(i, j int) bool { return visible[i].name < visible[j].name })
+
+	var b bytes.Buffer
+	b.WriteString("# HELP spw_build_info Version of server.\n# TYPE spw_build_info gauge\n")
+	b.WriteString("spw_build_info{version=\"" + labelvalue(ver) + "\"} 1\n")
+	for _, m := range metrics {
+		b.WriteString("# HELP " + m.name + " " + m.help + "\n# TYPE " + m.name + " " + m.kind + "\n")
+		for _, sp := range visible {
+			v := m.value(sp, portstatsof(sp.name))
+			b.WriteString(m.name + "{port=\"" + labelvalue(sp.name) + "\"} " + strconv.FormatUint(v, 10) + "\n")
+		}
+	}
+	// state is exposed as one series per state with value 1 for current.
+	b.WriteString("# HELP spw_port_state Lifecycle state of port, 1 for current state.\n# TYPE spw_port_state gauge\n")
+	for _, sp := range visible {
+		current := sp.getstate()
+		for state, name := range statenames {
+			v := "0"
+			if state == current {
+				v = "1"
+			}
+			b.WriteString("spw_port_state{port=\"" + labelvalue(sp.name) + "\",state=\"" + name + "\"} " + v + "\n")
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
+
+// labelvalue will escape label value as per exposition format.
+func labelvalue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// csrfheader must be sent with every request changing state. Browsers send
+// custom header cross site only after CORS preflight, which server never
+// allows, so page of other site can not forge such request.
+const csrfheader = "X-Requested-With"
+
+// sameorigin will return true if request comes from page of this server or
+// of origin allowed in auth origins. Request without Origin header is not
+// made by script of other site.
+func sameorigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	config.mu.Lock()
+	defer config.mu.Unlock()
+	for _, allowed := range config.Auth.Origins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// safemethod will return true for methods which do not change state.
+func safemethod(method string) bool {
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// csrfmiddleware will reject requests of pages of other sites, so that
+// they can not use session cookie or cached basic auth of browser. Requests
+// changing state also need csrfheader, unless they carry bearer token
+// which browser never adds by itself.
+func csrfmiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !sameorigin(r) {
+			log.Printf("[Client:%s]Request of origin %s to %s rejected", r.RemoteAddr, r.Header.Get("Origin"), r.URL.Path)
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Origin not allowed."))
+			return
+		}
+		if !safemethod(r.Method) && r.Header.Get(csrfheader) == "" &&
+			!strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+			log.Printf("[Client:%s]Request to %s without %s header rejected", r.RemoteAddr, r.URL.Path, csrfheader)
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(csrfheader + " header is required."))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
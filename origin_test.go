@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCsrfmiddleware(t *testing.T) {
+	config.mu.Lock()
+	saved := config.Auth.Origins
+	config.Auth.Origins = []string{"https://console.example.com/"}
+	config.mu.Unlock()
+	defer func() {
+		config.mu.Lock()
+		config.Auth.Origins = saved
+		config.mu.Unlock()
+	}()
+	handler := csrfmiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		method  string
+		headers map[string]string
+		want    int
+	}{
+		{"GET", nil, http.StatusOK},
+		{"GET", map[string]string{"Origin": "http://serial.lab:8080"}, http.StatusOK},
+		{"GET", map[string]string{"Origin": "https://evil.example.com"}, http.StatusForbidden},
+		{"GET", map[string]string{"Origin": "https://console.example.com"}, http.StatusOK},
+		// Form post of other site carries no custom header.
+		{"POST", nil, http.StatusForbidden},
+		{"POST", map[string]string{"Origin": "https://evil.example.com", csrfheader: "XMLHttpRequest"},
+			http.StatusForbidden},
+		{"POST", map[string]string{"Origin": "http://serial.lab:8080", csrfheader: "XMLHttpRequest"}, http.StatusOK},
+		{"POST", map[string]string{csrfheader: "curl"}, http.StatusOK},
+		{"DELETE", map[string]string{"Authorization": "Bearer tok3n"}, http.StatusOK},
+		{"DELETE", map[string]string{"Authorization": "Basic YWRtaW46c2VjcmV0"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "http://serial.lab:8080/stop?portname=/dev/ttyUSB0", nil)
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s with %v = %d, want %d", tt.method, tt.headers, w.Code, tt.want)
+		}
+	}
+}
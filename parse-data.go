@@ -5,18 +5,48 @@ import (
 	"errors"
 	"io/ioutil"
 	"log"
+	"strings"
 	"sync"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
 // port struct as per yaml config
 type port struct {
-	Name     string `yaml:"name"`
-	Baudrate int    `yaml:"baudrate"`
-	Parity   byte   `yaml:"parity"`
-	Desc     string `yaml:"desc"`
-	Status   uint8  `yaml:"status"`
+	Name       string `yaml:"name"`
+	lineconfig `yaml:",inline"`
+	Desc       string `yaml:"desc"`
+	Status     uint8  `yaml:"status"`
+	// Scrollback is size in bytes of recent output replayed to new sessions,
+	// 0 disables replay. Default is used when not given.
+	Scrollback *int `yaml:"scrollback,omitempty"`
+	// Logformat is format of capture log, raw, timestamp or json.
+	Logformat string `yaml:"logformat,omitempty"`
+	// Recordinput 1 records session input in capture log too.
+	Recordinput int `yaml:"recordinput,omitempty"`
+	// Recordsession 1 records websocket sessions as asciicast files.
+	Recordsession int `yaml:"recordsession,omitempty"`
+	// Match identifies device by USB identity or by-id link, Name is then
+	// only key of port used in API and log file names.
+	Match *matcher `yaml:"match,omitempty"`
+	// Maxidle overrides health maxidle for this port.
+	Maxidle time.Duration `yaml:"maxidle,omitempty"`
+	// Triggers are rules matched on output of port.
+	Triggers []trigger `yaml:"triggers,omitempty"`
+	// Jobs are scripts run on port by cron schedule.
+	Jobs []job `yaml:"jobs,omitempty"`
+}
+
+// default scrollback size in bytes if not provided in config.
+const defaultScrollback = 64 * 1024
+
+// scrollbacksize will return configured scrollback size or default.
+func (pc *port) scrollbacksize() int {
+	if pc.Scrollback != nil {
+		return *pc.Scrollback
+	}
+	return defaultScrollback
 }
 
 // Config type for YAML File marshall/unmarshall
@@ -28,29 +58,87 @@ type Config struct {
 		Maxsize    int    `yaml:"maxsize"`
 		Maxbackups int    `yaml:"maxbackups"`
 		Maxage     int    `yaml:"maxage"`
+		// Logformat is capture log format of ports without own logformat.
+		Logformat string `yaml:"logformat,omitempty"`
 	} `yaml:"logs"`
-	ServerConfig []struct {
-		Name    string `yaml:"name"`
-		Enable  int   `yaml:"enable"`
-		Port    int    `yaml:"port"`
-		SslCert string `yaml:"sslcert"`
-		SslKey  string `yaml:"sslkey"`
-	} `yaml:"serverconfig"`
+	ServerConfig []server `yaml:"serverconfig"`
+	Timeouts     timeouts `yaml:"timeouts,omitempty"`
+	// Backups is number of old config versions kept on every write.
+	Backups int `yaml:"backups,omitempty"`
+	// Health has thresholds of port readiness in /readyz.
+	Health health `yaml:"health,omitempty"`
+	// Auth is never sent to API clients as it has password hashes.
+	Auth authconfig `yaml:"auth" json:"-"`
+}
+
+// timeouts struct as per yaml config, values like 5s or 1m.
+type timeouts struct {
+	// Stop is how long stop, edit and delete wait for reader of port.
+	Stop time.Duration `yaml:"stop,omitempty"`
+	// Shutdown is how long graceful shutdown waits on SIGTERM/SIGINT.
+	Shutdown time.Duration `yaml:"shutdown,omitempty"`
+}
+
+// default timeout of stopping reader of port.
+const defaultStopTimeout = 5 * time.Second
+
+// stoptimeout will return configured stop timeout or default.
+func (config *Config) stoptimeout() time.Duration {
+	config.mu.Lock()
+	defer config.mu.Unlock()
+	if config.Timeouts.Stop <= 0 {
+		return defaultStopTimeout
+	}
+	return config.Timeouts.Stop
+}
+
+// logformat will return capture log format of port, its own one or logs
+// default. Built-in default is raw, export by time range needs timestamp
+// or json.
+func (config *Config) logformat(pc port) string {
+	if pc.Logformat != "" {
+		return pc.Logformat
+	}
+	config.mu.Lock()
+	defer config.mu.Unlock()
+	if config.Logs.Logformat == "" {
+		return logRaw
+	}
+	return config.Logs.Logformat
 }
 
-// writeYaml will write new change config struct to file
+// server struct as per yaml config for http, https and tcp listeners
+type server struct {
+	Name    string `yaml:"name"`
+	Enable  int    `yaml:"enable"`
+	Port    int    `yaml:"port"`
+	SslCert string `yaml:"sslcert,omitempty"`
+	SslKey  string `yaml:"sslkey,omitempty"`
+	// Serialport and Mode are used by tcp listener which serves console
+	// of one serial port in raw or rfc2217 mode.
+	Serialport string `yaml:"serialport,omitempty"`
+	Mode       string `yaml:"mode,omitempty"`
+	// Bind is address tcp listener binds to, all interfaces if empty.
+	Bind string `yaml:"bind,omitempty"`
+	// User is principal tcp sessions are attributed to. With auth enabled
+	// sessions get roles of this user without token prompt, so it is
+	// allowed only on loopback bind.
+	User string `yaml:"user,omitempty"`
+}
+
+// writeYaml will validate config and write it to file atomically, old
+// file is kept as backup.
 func (config *Config) writeYaml(filename string) error {
 	config.mu.Lock()
 	defer config.mu.Unlock()
-	out, err := yaml.Marshal(config)
-	if err != nil {
+	if err := config.validate(); err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(filename, out, 0644)
+	out, err := yaml.Marshal(config)
 	if err != nil {
 		return err
 	}
-	return nil
+	return writeconfigfile(filename, out, config.backupcount())
 }
 
 // parseYaml will return err or parse yaml file
@@ -64,15 +152,37 @@ func (config *Config) parseYaml(fileName string) error {
 		log.Printf("Error : %s", err)
 		return err
 	}
+	if err = config.check(true); err != nil {
+		return err
+	}
+	// logs dir is used as prefix of log file names.
+	if config.Logs.Inlogs != "" && !strings.HasSuffix(config.Logs.Inlogs, "/") {
+		config.Logs.Inlogs = config.Logs.Inlogs + "/"
+	}
+	for index := range config.Ports {
+		config.Ports[index].lineconfig = config.Ports[index].normalize()
+	}
 	return nil
 }
 
-// getJSON will convert struct to JSON format and return
-// converted byte slice or error
-func (config *Config) getJSON() ([]byte, error) {
+// getJSON will convert struct to JSON format with ports for which
+// show returns true and return converted byte slice or error
+func (config *Config) getJSON(show func(pname string) bool) ([]byte, error) {
 	config.mu.Lock()
-	defer config.mu.Unlock()
-	b, err := json.Marshal(config)
+	tmp := struct {
+		Ports        []port
+		Logs         interface{}
+		ServerConfig []server
+	}{Logs: config.Logs, ServerConfig: config.ServerConfig}
+	ports := append([]port(nil), config.Ports...)
+	config.mu.Unlock()
+	// show is called without lock as it may read config too.
+	for _, value := range ports {
+		if show(value.Name) {
+			tmp.Ports = append(tmp.Ports, value)
+		}
+	}
+	b, err := json.Marshal(&tmp)
 	if err != nil {
 		return []byte(""), err
 	}
@@ -108,20 +218,44 @@ func (c *Config) checkElement(portname string) bool {
 	return false
 }
 
-// addElement will add new element provided port name, baudrate
-// and description
-func (c *Config) addElement(portname string, baudrate int, des string) error {
+// addElement will add new element with provided port config
+func (c *Config) addElement(pc port) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	for _, value := range c.Ports {
-		if value.Name == portname {
+		if value.Name == pc.Name {
 			return errors.New("port name already exist")
 		}
 	}
-	c.Ports = append(c.Ports, port{Name: portname, Baudrate: baudrate, Desc: des, Status: 1})
+	c.Ports = append(c.Ports, pc)
 	return nil
 }
 
+// tcpserver will return tcp listener port serving given serial port, 0 if
+// there is none.
+func (c *Config) tcpserver(portname string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, value := range c.ServerConfig {
+		if value.Name == "tcp" && value.Enable == 1 && value.Serialport == portname {
+			return value.Port
+		}
+	}
+	return 0
+}
+
+// getElement will return port config for a given port
+func (c *Config) getElement(portname string) (port, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, value := range c.Ports {
+		if value.Name == portname {
+			return value, nil
+		}
+	}
+	return port{}, errors.New("port not found")
+}
+
 // update element description with given new description
 func (c *Config) updateElement(portname string, desc string) error {
 	c.mu.Lock()
@@ -135,6 +269,19 @@ func (c *Config) updateElement(portname string, desc string) error {
 	return errors.New("did not find any element with given port")
 }
 
+// setJobs will replace scheduled jobs of given port.
+func (c *Config) setJobs(portname string, jobs []job) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for index := range c.Ports {
+		if c.Ports[index].Name == portname {
+			c.Ports[index].Jobs = jobs
+			return nil
+		}
+	}
+	return errors.New("port not found")
+}
+
 // getStatus will return port status for a given port
 func (c *Config) getStatus(portname string) (uint8, error) {
 	c.mu.Lock()
@@ -1,26 +1,42 @@
 package main
 
 import (
+	"context"
 	"errors"
-	"strings"
+	"fmt"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"go.bug.st/serial"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 type serialport struct {
-	mu           sync.Mutex
-	port         serial.Port
-	name         string
-	baudrate     int
-	status       uint8
-	comm         chan string
+	mu     sync.Mutex
+	port   serial.Port
+	name   string
+	line   lineconfig
+	status uint8
+	// match identifies device when name is not tty path.
+	match *matcher
+	// device is tty path port was last opened with.
+	device string
+	// st is lifecycle state of port, guarded by mu.
+	st portstate
+	// comm will fan out data read from port to all sessions.
+	comm *broadcaster
+	// stats are counters of port for metrics.
+	stats        *portstats
 	infilelogger *lumberjack.Logger
-	// stop will be used by api request delete/edit/stop port.
-	stop chan struct{}
-	// ack will be returned by respective go routine on successful stop.
-	ack          chan struct{}
+	// capture will write port data into infilelogger in configured format.
+	capture *capturelog
+	// triggers are rules matched on data read from port.
+	triggers *triggerset
+	// cancel will stop reader go routine, used by delete/edit/stop port.
+	cancel context.CancelFunc
+	// wg is done when reader go routine returns.
+	wg           sync.WaitGroup
 	clientactive connection
 }
 
@@ -31,62 +47,177 @@ type allports struct {
 
 // jsonport struct
 type jsonport struct {
-	Newname  string `josn:"newname"`
-	Desc     string `json:"description"`
-	Baudrate int    `json:"baudrate"`
+	Newname     string `josn:"newname"`
+	Desc        string `json:"description"`
+	Baudrate    int    `json:"baudrate"`
+	Databits    int    `json:"databits"`
+	Parity      string `json:"parity"`
+	Stopbits    string `json:"stopbits"`
+	Flowcontrol string `json:"flowcontrol"`
+	// Match is optional, existing matcher is kept when not given.
+	Match *matcher `json:"match,omitempty"`
+}
+
+// portconfig will overlay posted JSON on given port config, so settings
+// which are not part of API are kept as it is.
+func (p *jsonport) portconfig(pc port) port {
+	pc.Name = p.Newname
+	pc.Desc = p.Desc
+	pc.lineconfig = p.lineconfig()
+	pc.Status = 1
+	if p.Match != nil {
+		pc.Match = p.Match
+	}
+	return pc
+}
+
+// lineconfig will return normalized line settings from posted JSON.
+func (p *jsonport) lineconfig() lineconfig {
+	return lineconfig{
+		Baudrate:    p.Baudrate,
+		Databits:    p.Databits,
+		Parity:      p.Parity,
+		Stopbits:    p.Stopbits,
+		Flowcontrol: p.Flowcontrol,
+	}.normalize()
 }
 
 // addnewport will add new port with given info for add/edit operation.
-func (p *allports) addnewport(pn string, pbr int, st uint8) error {
+func (p *allports) addnewport(pc port) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	for value := range p.ports {
-		if p.ports[value].name == pn {
+		if p.ports[value].name == pc.Name {
 			return errors.New("port already exist")
 		}
 	}
-	all.ports[pn] = &serialport{
-		mu:       sync.Mutex{},
-		port:     nil,
-		name:     pn,
-		baudrate: pbr,
-		status:   st,
-		comm:     make(chan string, 1024),
-		infilelogger: &lumberjack.Logger{Filename: config.Logs.Inlogs + strings.Split(pn, "/")[2] + ".txt",
-			MaxSize: config.Logs.Maxsize, MaxAge: config.Logs.Maxage, MaxBackups: config.Logs.Maxbackups},
-		stop: make(chan struct{}, 1),
-		ack:  make(chan struct{}),
-		clientactive: connection{
-			mu:         sync.Mutex{},
-			connection: 0,
-			raddr:      "",
-		},
-	}
+	all.ports[pc.Name] = newserialport(pc)
 	return nil
 }
 
 // initialize port will initialize default state for stop operation.
-func (p *allports) initializeport(pn string, pbr int, st uint8) error {
+func (p *allports) initializeport(pc port) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	all.ports[pn] = &serialport{
-		mu:       sync.Mutex{},
-		port:     nil,
-		name:     pn,
-		baudrate: pbr,
-		status:   st,
-		comm:     make(chan string, 1024),
-		infilelogger: &lumberjack.Logger{Filename: config.Logs.Inlogs + strings.Split(pn, "/")[2] + ".txt",
-			MaxSize: config.Logs.Maxsize, MaxAge: config.Logs.Maxage, MaxBackups: config.Logs.Maxbackups},
-		stop: make(chan struct{}, 1),
-		ack:  make(chan struct{}),
+	if sp, got := all.ports[pc.Name]; got {
+		sp.closelog()
+	}
+	all.ports[pc.Name] = newserialport(pc)
+	return nil
+}
+
+// newserialport will return serialport in default state for given port config.
+func newserialport(pc port) *serialport {
+	sp := &serialport{
+		mu:           sync.Mutex{},
+		port:         nil,
+		name:         pc.Name,
+		line:         pc.lineconfig,
+		status:       pc.Status,
+		match:        pc.Match,
+		stats:        portstatsof(pc.Name),
+		infilelogger: newportlogger(pc.Name),
 		clientactive: connection{
-			mu:         sync.Mutex{},
-			connection: 0,
-			raddr:      "",
+			mu:       sync.Mutex{},
+			sessions: make(map[uint64]*session),
 		},
 	}
-	return nil
+	sp.comm = newbroadcaster(pc.scrollbacksize(), sp.stats)
+	sp.capture = newcapturelog(sp.infilelogger, config.logformat(pc), pc.Recordinput == 1)
+	sp.triggers = newtriggerset(pc.Name, pc.Triggers)
+	sp.st = portstate{state: stateDisabled, since: time.Now()}
+	if pc.Status == 1 {
+		sp.st.state = stateOpening
+	}
+	return sp
+}
+
+// newportlogger will return logger of given port as per logs config.
+func newportlogger(pn string) *lumberjack.Logger {
+	config.mu.Lock()
+	defer config.mu.Unlock()
+	return &lumberjack.Logger{Filename: config.Logs.Inlogs + logname(pn) + ".txt",
+		MaxSize: config.Logs.Maxsize, MaxAge: config.Logs.Maxage, MaxBackups: config.Logs.Maxbackups}
+}
+
+// closelog will write pending capture data and close log file of port.
+func (sp *serialport) closelog() {
+	sp.capture.close()
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.infilelogger.Close()
+}
+
+// reopenlog will move log of port to current logs config, used when logs
+// config changes on reload.
+func (sp *serialport) reopenlog() {
+	l := newportlogger(sp.name)
+	sp.capture.setwriter(l)
+	if pc, err := config.getElement(sp.name); err == nil {
+		sp.capture.setformat(config.logformat(pc))
+	}
+	sp.mu.Lock()
+	old := sp.infilelogger
+	sp.infilelogger = l
+	sp.mu.Unlock()
+	old.Close()
+}
+
+// stopreader will cancel reader go routine of port and wait till it
+// returns, at most for configured stop timeout. Port is closed, so reader
+// blocked in read or waiting for retry returns at once.
+func (sp *serialport) stopreader() error {
+	sp.mu.Lock()
+	cancel := sp.cancel
+	sp.cancel = nil
+	sp.mu.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	sp.setstate(stateStopping, nil)
+	cancel()
+	all.mu.Lock()
+	if sp.port != nil {
+		sp.port.Close()
+	}
+	all.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		sp.wg.Wait()
+		close(done)
+	}()
+	timeout := config.stoptimeout()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		// Reader is left running detached, port is not stopped cleanly
+		// so it is reported in error state rather than stopping.
+		err := fmt.Errorf("reader of port %s did not stop in %s", sp.name, timeout)
+		sp.setstate(stateError, err)
+		return err
+	}
+}
+
+// devicepath will resolve tty path of port, port name is path itself
+// unless port has matcher.
+func (sp *serialport) devicepath() (string, error) {
+	if sp.match == nil {
+		return sp.name, nil
+	}
+	return sp.match.resolve()
+}
+
+// logname will return name used for log files of given port.
+func logname(pn string) string {
+	return filepath.Base(pn)
+}
+
+// getport will return opened serial port or nil if port is not open.
+func (sp *serialport) getport() serial.Port {
+	all.mu.Lock()
+	defer all.mu.Unlock()
+	return sp.port
 }
 
 // removeElement will remove given portname from map and return suceess
@@ -96,6 +227,7 @@ func (p *allports) removeElement(port string) bool {
 	defer p.mu.Unlock()
 	for name := range p.ports {
 		if name == port {
+			p.ports[port].closelog()
 			delete(p.ports, port)
 			return true
 		}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startreader will run fake reader of port which returns on cancel or
+// when stuck is closed, whichever it waits for.
+func startreader(sp *serialport, stuck chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sp.cancel = cancel
+	sp.wg.Add(1)
+	go func() {
+		defer sp.wg.Done()
+		if stuck != nil {
+			<-stuck
+			return
+		}
+		<-ctx.Done()
+	}()
+}
+
+func TestStopreader(t *testing.T) {
+	sp := &serialport{name: "/dev/ttyTEST0"}
+	if err := sp.stopreader(); err != nil {
+		t.Errorf("stopreader without reader: %s", err)
+	}
+	startreader(sp, nil)
+	if err := sp.stopreader(); err != nil {
+		t.Errorf("stopreader: %s", err)
+	}
+	if sp.cancel != nil {
+		t.Errorf("cancel is kept after stop")
+	}
+	// Second stop has nothing to wait for.
+	if err := sp.stopreader(); err != nil {
+		t.Errorf("second stopreader: %s", err)
+	}
+}
+
+func TestStopreaderTimeout(t *testing.T) {
+	config.mu.Lock()
+	saved := config.Timeouts.Stop
+	config.Timeouts.Stop = 20 * time.Millisecond
+	config.mu.Unlock()
+	defer func() {
+		config.mu.Lock()
+		config.Timeouts.Stop = saved
+		config.mu.Unlock()
+	}()
+	sp := &serialport{name: "/dev/ttyTEST1"}
+	stuck := make(chan struct{})
+	startreader(sp, stuck)
+	start := time.Now()
+	if err := sp.stopreader(); err == nil {
+		t.Errorf("stopreader of stuck reader returned no error")
+	}
+	if state := sp.getstate(); state != stateError || !strings.Contains(sp.st.lasterr, "did not stop") {
+		t.Errorf("stuck reader left port %s with error %q", statenames[state], sp.st.lasterr)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("stopreader waited %s, stop timeout is 20ms", waited)
+	}
+	close(stuck)
+	sp.wg.Wait()
+}
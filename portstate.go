@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// lifecycle states of serial port.
+const (
+	// stateDisabled port is disabled in config, reader is not running.
+	stateDisabled = iota
+	// stateOpening reader is resolving and opening device.
+	stateOpening
+	// stateOpen device is open and streaming.
+	stateOpen
+	// stateError opening or reading failed, reader backs off till retry.
+	stateError
+	// stateStopping reader is asked to stop by stop/edit/delete request.
+	stateStopping
+)
+
+var statenames = []string{"disabled", "opening", "open", "error", "stopping"}
+
+// portstate holds lifecycle state of serial port, it is guarded by mu of
+// serialport.
+type portstate struct {
+	state int
+	since time.Time
+	// lasterr is last open or read error, kept after recovery.
+	lasterr    string
+	errortime  time.Time
+	retryat    time.Time
+	reconnects int
+	// opened tells port was open once, so next open is a reconnect.
+	opened bool
+}
+
+// portstatus struct is JSON status of port for API.
+type portstatus struct {
+	Name       string     `json:"name"`
+	Desc       string     `json:"desc"`
+	State      string     `json:"state"`
+	Since      time.Time  `json:"since"`
+	Device     string     `json:"device,omitempty"`
+	Line       string     `json:"line"`
+	Lasterror  string     `json:"lasterror,omitempty"`
+	Errortime  *time.Time `json:"errortime,omitempty"`
+	Retryat    *time.Time `json:"retryat,omitempty"`
+	Reconnects int        `json:"reconnects"`
+	Sessions   int        `json:"sessions"`
+}
+
+// setstate will move port to given state, err is recorded as last error.
+func (sp *serialport) setstate(state int, err error) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if err != nil {
+		sp.st.lasterr = err.Error()
+		sp.st.errortime = time.Now()
+	}
+	if state == stateOpen {
+		if sp.st.opened {
+			sp.st.reconnects = sp.st.reconnects + 1
+			sp.stats.add(&sp.stats.reconnects, 1)
+		}
+		sp.st.opened = true
+	}
+	if state != stateError {
+		sp.st.retryat = time.Time{}
+	}
+	if sp.st.state == state {
+		return
+	}
+	log.Printf("Port:%s state %s -> %s", sp.name, statenames[sp.st.state], statenames[state])
+	sp.st.state = state
+	sp.st.since = time.Now()
+}
+
+// backoff will move port to error state till given retry time.
+func (sp *serialport) backoff(err error, retry time.Duration) {
+	sp.setstate(stateError, err)
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.st.retryat = time.Now().Add(retry)
+}
+
+// getstate will return current state of port.
+func (sp *serialport) getstate() int {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.st.state
+}
+
+// portstatus will return status of port for API.
+func (sp *serialport) portstatus() portstatus {
+	sp.mu.Lock()
+	st := sp.st
+	sp.mu.Unlock()
+	ps := portstatus{
+		Name:       sp.name,
+		State:      statenames[st.state],
+		Since:      st.since.UTC(),
+		Line:       sp.line.summary(),
+		Lasterror:  st.lasterr,
+		Reconnects: st.reconnects,
+		Sessions:   sp.clientactive.getconncount(),
+	}
+	all.mu.Lock()
+	ps.Device = sp.device
+	all.mu.Unlock()
+	if pc, err := config.getElement(sp.name); err == nil {
+		ps.Desc = pc.Desc
+	}
+	if !st.errortime.IsZero() {
+		t := st.errortime.UTC()
+		ps.Errortime = &t
+	}
+	if !st.retryat.IsZero() {
+		t := st.retryat.UTC()
+		ps.Retryat = &t
+	}
+	return ps
+}
+
+// getPorts will return status of all ports user can view.
+func getPorts(w http.ResponseWriter, r *http.Request) {
+	all.mu.Lock()
+	var ports []*serialport
+	for _, sp := range all.ports {
+		ports = append(ports, sp)
+	}
+	all.mu.Unlock()
+	list := []portstatus{}
+	for _, sp := range ports {
+		if portrole(r, sp.name) >= roleViewer {
+			list = append(list, sp.portstatus())
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writejson(w, list)
+}
+
+// getPortStatus will return status of single port. Path of port name is
+// cleaned by router, so /ports/dev/ttyUSB1/status is same as /dev/ttyUSB1.
+func getPortStatus(w http.ResponseWriter, r *http.Request) {
+	sp, pname := pathport(r)
+	if sp == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Port not found."))
+		return
+	}
+	if !authorize(w, r, pname, roleViewer) {
+		return
+	}
+	writejson(w, sp.portstatus())
+}
+
+// pathport will return port named in path of /ports/{name} routes and its
+// name. Leading slash of tty path is optional, /ports/dev/ttyUSB1 is port
+// /dev/ttyUSB1. Port is nil if not found.
+func pathport(r *http.Request) (*serialport, string) {
+	pname := mux.Vars(r)["name"]
+	all.mu.Lock()
+	defer all.mu.Unlock()
+	if sp, got := all.ports[pname]; got {
+		return sp, pname
+	}
+	if sp, got := all.ports["/"+pname]; got {
+		return sp, "/" + pname
+	}
+	return nil, pname
+}
+
+// writejson will write given value as JSON response.
+func writejson(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error in JSON Marshal: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// recordingsdir keeps session recordings under logs dir.
+const recordingsdir = "recordings/"
+
+// default terminal size of recording till client reports its size.
+const (
+	defaultCols = 80
+	defaultRows = 24
+)
+
+// castheader is first line of asciicast v2 file. User, port, raddr and
+// start are session metadata, players ignore keys they do not know.
+type castheader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	User      string            `json:"user,omitempty"`
+	Port      string            `json:"port"`
+	Raddr     string            `json:"raddr"`
+	Start     time.Time         `json:"start"`
+}
+
+// castrecorder will record websocket session as asciicast v2 file, output
+// as o events, input written to port as i events and terminal size changes
+// as r events. Header is written with first event, so terminal size
+// reported by client before any event goes into header. Methods are nil
+// safe, so session without recording calls them on nil recorder.
+type castrecorder struct {
+	mu      sync.Mutex
+	f       *os.File
+	name    string
+	header  castheader
+	started bool
+	// pending keeps incomplete UTF-8 sequence of output till next chunk.
+	pending []byte
+	// tail is last output line, secret input at password prompt is
+	// recorded as * like in serial log.
+	tail    []byte
+	secret  bool
+	inline  bool
+	isecret bool
+}
+
+// newcastrecorder will create recording file of session s on port.
+func newcastrecorder(pn string, s *session, t time.Time) (*castrecorder, error) {
+	config.mu.Lock()
+	dir := config.Logs.Inlogs + recordingsdir
+	config.mu.Unlock()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	name := logname(pn) + "-" + t.UTC().Format("20060102T150405Z") + "-" + strconv.FormatUint(s.id, 10) + ".cast"
+	f, err := os.OpenFile(dir+name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &castrecorder{f: f, name: name, header: castheader{Version: 2, Width: defaultCols,
+		Height: defaultRows, Timestamp: t.Unix(), Title: "Port:" + pn + " " + s.who(),
+		Env: map[string]string{"TERM": "xterm-256color"}, User: s.user, Port: pn, Raddr: s.raddr,
+		Start: t.UTC()}}, nil
+}
+
+// writeheader will write header once. Caller must hold mu.
+func (c *castrecorder) writeheader() {
+	if !c.started {
+		b, _ := json.Marshal(c.header)
+		c.f.Write(append(b, '\n'))
+		c.started = true
+	}
+}
+
+// event will write event of given type at time t. Caller must hold mu.
+func (c *castrecorder) event(kind string, data string, t time.Time) {
+	c.writeheader()
+	offset := t.Sub(c.header.Start).Seconds()
+	if offset < 0 {
+		offset = 0
+	}
+	b, err := json.Marshal([]interface{}{json.Number(strconv.FormatFloat(offset, 'f', 6, 64)), kind, data})
+	if err != nil {
+		return
+	}
+	if _, err = c.f.Write(append(b, '\n')); err != nil {
+		log.Printf("Error writing recording %s: %s", c.name, err)
+	}
+}
+
+// output will record output sent to session.
+func (c *castrecorder) output(data []byte, t time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data = append(c.pending, data...)
+	cut := len(data)
+	// Serial output can split multi byte character between reads.
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	c.pending = append([]byte(nil), data[cut:]...)
+	if cut == 0 {
+		return
+	}
+	for _, b := range data[:cut] {
+		if b == '\n' {
+			c.tail = c.tail[:0]
+		} else if len(c.tail) < 256 {
+			c.tail = append(c.tail, b)
+		}
+	}
+	c.event("o", string(data[:cut]), t)
+}
+
+// input will record data typed by session, line started at password
+// prompt or after secret control is recorded as *.
+func (c *castrecorder) input(data []byte, t time.Time) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]byte, 0, len(data))
+	for _, b := range data {
+		if b == '\r' || b == '\n' {
+			c.inline = false
+			c.isecret = false
+			out = append(out, b)
+			continue
+		}
+		if !c.inline {
+			c.inline = true
+			c.isecret = c.secret || passwordprompt.Match(c.tail)
+			c.secret = false
+		}
+		if c.isecret && b >= 0x20 && b != 0x7f {
+			b = '*'
+		}
+		out = append(out, b)
+	}
+	c.event("i", string(out), t)
+}
+
+// secretinput will record current or next input line as secret.
+func (c *castrecorder) secretinput() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inline {
+		c.isecret = true
+	} else {
+		c.secret = true
+	}
+}
+
+// resize will record terminal size reported by client.
+func (c *castrecorder) resize(cols int, rows int, t time.Time) {
+	if c == nil || cols <= 0 || rows <= 0 || cols > 1000 || rows > 1000 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.started {
+		c.header.Width, c.header.Height = cols, rows
+		return
+	}
+	c.event("r", strconv.Itoa(cols)+"x"+strconv.Itoa(rows), t)
+}
+
+// close will write header of session without events and close file.
+func (c *castrecorder) close() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeheader()
+	if err := c.f.Close(); err != nil {
+		log.Printf("Error closing recording %s: %s", c.name, err)
+	}
+}
+
+// recording is entry of recordings API.
+type recording struct {
+	Name string `json:"name"`
+	// URL is path recording is served at under /logs/.
+	URL      string    `json:"url"`
+	Port     string    `json:"port"`
+	User     string    `json:"user,omitempty"`
+	Raddr    string    `json:"raddr"`
+	Start    time.Time `json:"start"`
+	Width    int       `json:"width"`
+	Height   int       `json:"height"`
+	Duration float64   `json:"duration"`
+	Size     int64     `json:"size"`
+}
+
+// readrecording will return metadata of recording file from its header and
+// time of its last event.
+func readrecording(dir string, name string) (recording, error) {
+	rec := recording{Name: name, URL: "/logs/" + recordingsdir + name}
+	f, err := os.Open(dir + name)
+	if err != nil {
+		return rec, err
+	}
+	defer f.Close()
+	line, err := bufio.NewReaderSize(f, 4096).ReadBytes('\n')
+	if err != nil {
+		return rec, err
+	}
+	var h castheader
+	if err = json.Unmarshal(line, &h); err != nil {
+		return rec, err
+	}
+	rec.Port, rec.User, rec.Raddr, rec.Start = h.Port, h.User, h.Raddr, h.Start
+	rec.Width, rec.Height = h.Width, h.Height
+	st, err := f.Stat()
+	if err != nil {
+		return rec, err
+	}
+	rec.Size = st.Size()
+	// last event is in last 4KB unless it is huge, duration is 0 then.
+	from := rec.Size - 4096
+	if from < 0 {
+		from = 0
+	}
+	tail := make([]byte, rec.Size-from)
+	if _, err = f.ReadAt(tail, from); err != nil && err != io.EOF {
+		return rec, err
+	}
+	lines := strings.Split(strings.TrimRight(string(tail), "\n"), "\n")
+	var ev []interface{}
+	if json.Unmarshal([]byte(lines[len(lines)-1]), &ev) == nil && len(ev) == 3 {
+		if d, ok := ev[0].(float64); ok {
+			rec.Duration = d
+		}
+	}
+	return rec, nil
+}
+
+// getRecordings will return recordings of ports user can view as JSON
+// array, newest first. port filters by port, limit keeps newest (default
+// 100).
+func getRecordings(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if v := r.FormValue("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid limit."))
+			return
+		}
+	}
+	pname := r.FormValue("port")
+	config.mu.Lock()
+	dir := config.Logs.Inlogs + recordingsdir
+	config.mu.Unlock()
+	list := []recording{}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("[Client:%s]Error reading recordings: %s", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error reading recordings."))
+		return
+	}
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), ".cast") {
+			continue
+		}
+		rec, err := readrecording(dir, fi.Name())
+		if err != nil || (pname != "" && rec.Port != pname) || portrole(r, rec.Port) < roleViewer {
+			continue
+		}
+		list = append(list, rec)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Start.After(list[j].Start) })
+	if len(list) > limit {
+		list = list[:limit]
+	}
+	writejson(w, list)
+}
+
+// serveReplayHtml handler
+func serveReplayHtml(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := template.ParseFiles(absPath + "/ui/replay.html")
+	if err != nil {
+		log.Printf("Replay.html serve error:%s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, nil)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+// recordtest will record session events into temp logs dir and return
+// header and events of cast file.
+func recordtest(t *testing.T, events func(c *castrecorder, t0 time.Time)) (castheader, [][]interface{}) {
+	t.Helper()
+	config.mu.Lock()
+	saved := config.Logs.Inlogs
+	config.Logs.Inlogs = t.TempDir() + "/"
+	dir := config.Logs.Inlogs
+	config.mu.Unlock()
+	defer func() {
+		config.mu.Lock()
+		config.Logs.Inlogs = saved
+		config.mu.Unlock()
+	}()
+	var conn connection
+	s := conn.attach("192.0.2.1:1234", "alice", "websocket")
+	t0 := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	c, err := newcastrecorder("/dev/ttyUSB0", s, t0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events(c, t0)
+	c.close()
+	f, err := os.Open(dir + recordingsdir + c.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	var h castheader
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &h) != nil {
+		t.Fatalf("no header in %s", c.name)
+	}
+	var list [][]interface{}
+	for scanner.Scan() {
+		var e []interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("event %q: %s", scanner.Text(), err)
+		}
+		list = append(list, e)
+	}
+	return h, list
+}
+
+// wantevents will compare type and data of events.
+func wantevents(t *testing.T, got [][]interface{}, want ...string) {
+	t.Helper()
+	if len(got) != len(want)/2 {
+		t.Fatalf("events = %v, want %q", got, want)
+	}
+	for index, e := range got {
+		if e[1] != want[2*index] || e[2] != want[2*index+1] {
+			t.Errorf("event %d = %v, want %s %q", index, e, want[2*index], want[2*index+1])
+		}
+	}
+}
+
+func TestCastHeader(t *testing.T) {
+	h, list := recordtest(t, func(c *castrecorder, t0 time.Time) {
+		// Size reported before first event goes into header.
+		c.resize(132, 43, t0)
+		c.output([]byte("hi"), t0.Add(1500*time.Millisecond))
+		c.resize(100, 30, t0.Add(2*time.Second))
+		c.resize(0, 30, t0.Add(2*time.Second))
+	})
+	if h.Version != 2 || h.Width != 132 || h.Height != 43 || h.User != "alice" || h.Port != "/dev/ttyUSB0" ||
+		h.Timestamp != time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Unix() {
+		t.Errorf("header = %+v", h)
+	}
+	wantevents(t, list, "o", "hi", "r", "100x30")
+	if list[0][0] != 1.5 {
+		t.Errorf("offset of first event = %v, want 1.5", list[0][0])
+	}
+}
+
+func TestCastSplitUTF8(t *testing.T) {
+	_, list := recordtest(t, func(c *castrecorder, t0 time.Time) {
+		c.output([]byte("caf\xc3"), t0)
+		c.output([]byte("\xa9 \xe2\x82"), t0)
+		c.output([]byte("\xac\n"), t0)
+		// Byte which can not start character is not held back.
+		c.output([]byte("x\xff"), t0)
+	})
+	wantevents(t, list, "o", "caf", "o", "é ", "o", "€\n", "o", "x�")
+}
+
+func TestCastSecretInput(t *testing.T) {
+	_, list := recordtest(t, func(c *castrecorder, t0 time.Time) {
+		c.output([]byte("login: "), t0)
+		c.input([]byte("admin\r"), t0)
+		c.output([]byte("\nPassword: "), t0)
+		c.input([]byte("hun"), t0)
+		c.input([]byte("ter2\r"), t0)
+		c.output([]byte("\n# "), t0)
+		c.secretinput()
+		c.input([]byte("s3\r"), t0)
+		c.input([]byte("ls"), t0)
+		// Secret marked in middle of line covers rest of it.
+		c.secretinput()
+		c.input([]byte("x\r"), t0)
+	})
+	wantevents(t, list, "o", "login: ", "i", "admin\r", "o", "\nPassword: ", "i", "***", "i", "****\r",
+		"o", "\n# ", "i", "**\r", "i", "ls", "i", "*\r")
+}
+
+func TestCastNilRecorder(t *testing.T) {
+	var c *castrecorder
+	c.output([]byte("x"), time.Now())
+	c.input([]byte("x"), time.Now())
+	c.secretinput()
+	c.resize(80, 24, time.Now())
+	c.close()
+}
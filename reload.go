@@ -0,0 +1,255 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// configchangemu serializes config changes, reload, rollback and API calls
+// which change ports, so that no change is applied on top of half done one.
+var configchangemu sync.Mutex
+
+// withconfigchange will wrap handler which changes config with
+// configchangemu.
+func withconfigchange(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		configchangemu.Lock()
+		defer configchangemu.Unlock()
+		next(w, r)
+	}
+}
+
+// restartneeded will return true if port has to be reopened to apply new
+// config, description alone is applied without restart.
+func restartneeded(old port, pc port) bool {
+	return old.lineconfig != pc.lineconfig || old.Status != pc.Status ||
+		old.scrollbacksize() != pc.scrollbacksize() || old.Logformat != pc.Logformat ||
+		old.Recordinput != pc.Recordinput || !samematcher(old.Match, pc.Match)
+}
+
+// reloadtriggers will replace output triggers of running port.
+func reloadtriggers(pc port) {
+	all.mu.Lock()
+	sp, got := all.ports[pc.Name]
+	all.mu.Unlock()
+	if got {
+		sp.triggers.set(pc.Triggers)
+	}
+}
+
+// samematcher will compare matchers by value.
+func samematcher(a *matcher, b *matcher) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// reloadconfig will read config file again and apply it without restart.
+// New ports are started, removed ones are stopped and only ports whose
+// serial settings changed are restarted. Sessions of stopped and restarted
+// ports are closed. Invalid config is rejected as a whole and running
+// config is kept.
+func reloadconfig(trigger string) error {
+	configchangemu.Lock()
+	defer configchangemu.Unlock()
+	return applyconfig(trigger)
+}
+
+// applyconfig will apply config file as per reloadconfig, caller holds
+// configchangemu.
+func applyconfig(trigger string) error {
+	if shuttingdown() {
+		return nil
+	}
+	sdnotify(reloading())
+	defer sdnotify("READY=1")
+	newconfig := &Config{}
+	if err := newconfig.parseYaml(*conf); err != nil {
+		configloaded(err)
+		log.Printf("Config reload on %s rejected: %s", trigger, err)
+		audit(auditentry{Actor: trigger, Action: "config.reload", Result: "rejected: " + err.Error()})
+		return err
+	}
+
+	config.mu.Lock()
+	oldports := append([]port(nil), config.Ports...)
+	oldservers := append([]server(nil), config.ServerConfig...)
+	oldlogs := config.Logs
+	config.Ports = newconfig.Ports
+	config.Logs = newconfig.Logs
+	config.ServerConfig = newconfig.ServerConfig
+	config.Timeouts = newconfig.Timeouts
+	config.Backups = newconfig.Backups
+	config.Health = newconfig.Health
+	config.Auth = newconfig.Auth
+	config.mu.Unlock()
+
+	configloaded(nil)
+
+	changes := 0
+	if newconfig.Logs != oldlogs {
+		changes++
+		reloadlogs()
+	}
+
+	oldbyname := make(map[string]port)
+	for _, pc := range oldports {
+		oldbyname[pc.Name] = pc
+	}
+	newbyname := make(map[string]port)
+	for _, pc := range newconfig.Ports {
+		newbyname[pc.Name] = pc
+	}
+	for _, pc := range oldports {
+		if _, got := newbyname[pc.Name]; !got {
+			changes++
+			before := pc
+			reloadremoveport(pc.Name, "removed")
+			audit(auditentry{Actor: trigger, Action: "config.reload", Port: pc.Name,
+				Before: &before, Result: "ok"})
+		}
+	}
+	for _, pc := range newconfig.Ports {
+		old, got := oldbyname[pc.Name]
+		switch {
+		case !got:
+			log.Printf("Port:%s added by config reload.", pc.Name)
+			all.addnewport(pc)
+			initializereader(pc.Name)
+		case restartneeded(old, pc):
+			reloadremoveport(pc.Name, "changed")
+			all.addnewport(pc)
+			initializereader(pc.Name)
+		case old.Desc != pc.Desc || !reflect.DeepEqual(old.Triggers, pc.Triggers) ||
+			!reflect.DeepEqual(old.Jobs, pc.Jobs):
+			// description is served from config, triggers are replaced
+			// in place and jobs rescheduled below, no restart needed.
+			reloadtriggers(pc)
+		default:
+			continue
+		}
+		changes++
+		after := pc
+		entry := auditentry{Actor: trigger, Action: "config.reload", Port: pc.Name,
+			After: &after, Result: "ok"}
+		if got {
+			entry.Before = &old
+		}
+		audit(entry)
+	}
+
+	changes = changes + reloadservers(oldservers, newconfig.ServerConfig)
+	syncjobs()
+	if changes == 0 {
+		log.Printf("Config reload on %s: no changes.", trigger)
+		return nil
+	}
+	log.Printf("Config reloaded on %s with %d change(s).", trigger, changes)
+	return nil
+}
+
+// reloadremoveport will close sessions of port, stop its reader and remove
+// it from allports.
+func reloadremoveport(pn string, reason string) {
+	all.mu.Lock()
+	sp, got := all.ports[pn]
+	all.mu.Unlock()
+	if !got {
+		return
+	}
+	log.Printf("Port:%s %s by config reload, stopping.", pn, reason)
+	sp.clientactive.closeall("Port " + reason + " by config reload")
+	if err := sp.stopreader(); err != nil {
+		log.Printf("Error stopping reader of port:%s %s", pn, err)
+	}
+	all.removeElement(pn)
+}
+
+// reloadlogs will apply new logs config to agent log, audit log and logs
+// of running ports.
+func reloadlogs() {
+	config.mu.Lock()
+	dir := config.Logs.Inlogs
+	config.mu.Unlock()
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		log.Printf("Error creating logs dir %s: %s. Logs config not applied.", dir, err)
+		return
+	}
+	old := agentlogger
+	agentlogger = newagentlogger()
+	log.SetOutput(agentlogger)
+	old.Close()
+	closeaudit()
+	if err := openaudit(dir); err != nil {
+		log.Printf("Error opening audit log in %s: %s", dir, err)
+	}
+	all.mu.Lock()
+	var ports []*serialport
+	for _, sp := range all.ports {
+		ports = append(ports, sp)
+	}
+	all.mu.Unlock()
+	for _, sp := range ports {
+		sp.reopenlog()
+	}
+	log.Printf("Logs config applied, logs dir:%s", dir)
+}
+
+// reloadservers will stop listeners which are removed or changed and start
+// new ones, it returns number of changed listeners. Listeners started here
+// only log their errors, they do not stop service.
+func reloadservers(old []server, newservers []server) int {
+	changes := 0
+	running := make(map[server]bool)
+	for _, value := range old {
+		running[value] = value.Enable == 1
+	}
+	wanted := make(map[server]bool)
+	for _, value := range newservers {
+		wanted[value] = value.Enable == 1
+	}
+	for value, on := range running {
+		if on && !wanted[value] {
+			changes++
+			stopserver(value)
+		}
+	}
+	for _, value := range newservers {
+		if value.Enable == 1 && !running[value] {
+			changes++
+			startserver(value, nil)
+		}
+	}
+	return changes
+}
+
+// watchconfig will reload config when config file changes, checked at
+// given interval.
+func watchconfig(interval time.Duration) {
+	log.Printf("Watching config file %s for changes every %s.", *conf, interval)
+	var last os.FileInfo
+	if fi, err := os.Stat(*conf); err == nil {
+		last = fi
+	}
+	for range time.Tick(interval) {
+		fi, err := os.Stat(*conf)
+		if err != nil {
+			continue
+		}
+		if last != nil && fi.ModTime().Equal(last.ModTime()) && fi.Size() == last.Size() {
+			continue
+		}
+		last = fi
+		// Config written by API or rollback is already applied.
+		if data, err := ioutil.ReadFile(*conf); err == nil && ownwrite(data) {
+			continue
+		}
+		reloadconfig("file change")
+	}
+}
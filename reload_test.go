@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestartneeded(t *testing.T) {
+	base := port{Name: "/dev/ttyUSB0", lineconfig: lineconfig{Baudrate: 9600}, Desc: "lab", Status: 1}
+	changes := map[string]func(pc *port){
+		"baudrate":      func(pc *port) { pc.Baudrate = 115200 },
+		"parity":        func(pc *port) { pc.Parity = "even" },
+		"status":        func(pc *port) { pc.Status = 2 },
+		"scrollback":    func(pc *port) { pc.Scrollback = intp(1024) },
+		"no scrollback": func(pc *port) { pc.Scrollback = intp(0) },
+		"logformat":     func(pc *port) { pc.Logformat = logJSON },
+		"recordinput":   func(pc *port) { pc.Recordinput = 1 },
+		"match":         func(pc *port) { pc.Match = &matcher{Serialnumber: "A1"} },
+	}
+	for name, change := range changes {
+		pc := base
+		change(&pc)
+		if !restartneeded(base, pc) {
+			t.Errorf("change of %s does not restart port", name)
+		}
+	}
+	pc := base
+	pc.Desc = "core switch"
+	// Default scrollback given explicitly is same size.
+	pc.Scrollback = intp(defaultScrollback)
+	if restartneeded(base, pc) {
+		t.Errorf("change of description restarts port")
+	}
+	old := base
+	old.Match = &matcher{Serialnumber: "A1"}
+	pc = base
+	pc.Match = &matcher{Serialnumber: "A1"}
+	if restartneeded(old, pc) {
+		t.Errorf("equal matchers restart port")
+	}
+}
+
+// reloadfile will return config with one disabled port of given
+// description, parity and logs in dir.
+func reloadfile(dir string, desc string, parity string) string {
+	return fmt.Sprintf(`
+ports:
+  - name: /dev/ttyTEST0
+    baudrate: 9600
+    parity: %s
+    desc: %s
+    status: 2
+logs:
+  inlogs: %s
+`, parity, desc, dir)
+}
+
+// reloadtest will write config file, load it as running config and restore
+// running config once test ends.
+func reloadtest(t *testing.T, data string) string {
+	file := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	savedconf := *conf
+	config.mu.Lock()
+	ports, logs, servers := config.Ports, config.Logs, config.ServerConfig
+	config.Ports = nil
+	config.mu.Unlock()
+	t.Cleanup(func() {
+		*conf = savedconf
+		config.mu.Lock()
+		config.Ports, config.Logs, config.ServerConfig = ports, logs, servers
+		config.mu.Unlock()
+	})
+	*conf = file
+	if err := config.parseYaml(file); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestReloadDescription(t *testing.T) {
+	dir := t.TempDir() + "/"
+	file := reloadtest(t, reloadfile(dir, "lab", "none"))
+	if err := ioutil.WriteFile(file, []byte(reloadfile(dir, "core switch", "none")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadconfig("test"); err != nil {
+		t.Fatalf("reload: %s", err)
+	}
+	if got := config.Ports[0].Desc; got != "core switch" {
+		t.Errorf("description after reload = %q", got)
+	}
+}
+
+func TestReloadRejected(t *testing.T) {
+	dir := t.TempDir() + "/"
+	file := reloadtest(t, reloadfile(dir, "lab", "none"))
+	if err := ioutil.WriteFile(file, []byte(reloadfile(dir, "core switch", "maybe")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadconfig("test"); err == nil {
+		t.Fatalf("reload of invalid config succeeded")
+	}
+	if got := config.Ports[0].Desc; got != "lab" {
+		t.Errorf("running config changed by rejected reload, description %q", got)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+// Telnet commands and options used by RFC 2217 (telnet com port control).
+const (
+	telnetSE   byte = 240
+	telnetSB   byte = 250
+	telnetWILL byte = 251
+	telnetWONT byte = 252
+	telnetDO   byte = 253
+	telnetDONT byte = 254
+	telnetIAC  byte = 255
+
+	optBinary  byte = 0
+	optEcho    byte = 1
+	optSGA     byte = 3
+	optComPort byte = 44
+)
+
+// COM-PORT-OPTION commands sent by client, server reply is command + 100.
+const (
+	cpSignature         byte = 0
+	cpSetBaudrate       byte = 1
+	cpSetDatasize       byte = 2
+	cpSetParity         byte = 3
+	cpSetStopsize       byte = 4
+	cpSetControl        byte = 5
+	cpNotifyLinestate   byte = 6
+	cpNotifyModemstate  byte = 7
+	cpFlowSuspend       byte = 8
+	cpFlowResume        byte = 9
+	cpSetLinestateMask  byte = 10
+	cpSetModemstateMask byte = 11
+	cpPurgeData         byte = 12
+	cpServerOffset      byte = 100
+)
+
+// telnet parser states.
+const (
+	tsData = iota
+	tsIAC
+	tsOption
+	tsSB
+	tsSBIAC
+)
+
+// maxsb is longest subnegotiation kept, enough for any COM-PORT-OPTION.
+// Longer one is dropped so client can not make server buffer endless data.
+const maxsb = 64
+
+// telnet will split telnet stream of client into data and commands.
+// Option negotiation is answered through reply, com port subnegotiation
+// is passed to comport.
+type telnet struct {
+	state int
+	verb  byte
+	sb    []byte
+	// sbdrop tells current subnegotiation is longer than maxsb.
+	sbdrop  bool
+	enabled map[byte]bool
+	reply   func([]byte)
+	comport func(cmd byte, data []byte)
+}
+
+func newtelnet(reply func([]byte), comport func(byte, []byte)) *telnet {
+	return &telnet{
+		enabled: make(map[byte]bool),
+		reply:   reply,
+		comport: comport,
+	}
+}
+
+// start will send initial option negotiation to client. Binary, SGA and
+// echo make telnet clients pass every key as it is, device echoes input.
+func (t *telnet) start() {
+	for _, opt := range []byte{optBinary, optSGA, optEcho} {
+		t.enabled[opt|0x80] = true
+	}
+	for _, opt := range []byte{optBinary, optSGA, optComPort} {
+		t.enabled[opt] = true
+	}
+	t.reply([]byte{
+		telnetIAC, telnetWILL, optBinary,
+		telnetIAC, telnetDO, optBinary,
+		telnetIAC, telnetWILL, optSGA,
+		telnetIAC, telnetDO, optSGA,
+		telnetIAC, telnetWILL, optEcho,
+		telnetIAC, telnetDO, optComPort,
+	})
+}
+
+// parse will consume bytes received from client and return console data.
+func (t *telnet) parse(in []byte) []byte {
+	out := make([]byte, 0, len(in))
+	for _, b := range in {
+		switch t.state {
+		case tsData:
+			if b == telnetIAC {
+				t.state = tsIAC
+			} else {
+				out = append(out, b)
+			}
+		case tsIAC:
+			switch b {
+			case telnetIAC:
+				out = append(out, b)
+				t.state = tsData
+			case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+				t.verb = b
+				t.state = tsOption
+			case telnetSB:
+				t.sb = t.sb[:0]
+				t.sbdrop = false
+				t.state = tsSB
+			default:
+				// NOP, break, go ahead and others are ignored.
+				t.state = tsData
+			}
+		case tsOption:
+			t.negotiate(t.verb, b)
+			t.state = tsData
+		case tsSB:
+			if b == telnetIAC {
+				t.state = tsSBIAC
+			} else {
+				t.sbappend(b)
+			}
+		case tsSBIAC:
+			if b == telnetSE {
+				if !t.sbdrop && len(t.sb) >= 2 && t.sb[0] == optComPort {
+					t.comport(t.sb[1], append([]byte(nil), t.sb[2:]...))
+				}
+				t.state = tsData
+			} else {
+				t.sbappend(b)
+				t.state = tsSB
+			}
+		}
+	}
+	return out
+}
+
+// sbappend will add byte to subnegotiation, subnegotiation over maxsb is
+// marked to be dropped.
+func (t *telnet) sbappend(b byte) {
+	if len(t.sb) >= maxsb {
+		t.sbdrop = true
+		return
+	}
+	t.sb = append(t.sb, b)
+}
+
+// negotiate will answer option request of client. Only options which are
+// supported get positive answer and answer is sent only once per option.
+func (t *telnet) negotiate(verb byte, opt byte) {
+	supported := opt == optBinary || opt == optSGA || opt == optComPort
+	key := opt
+	if verb == telnetDO || verb == telnetDONT {
+		// Options server performs are kept apart from options client performs.
+		key = opt | 0x80
+		supported = supported || opt == optEcho
+	}
+	switch verb {
+	case telnetWILL, telnetDO:
+		if !supported {
+			if verb == telnetWILL {
+				t.reply([]byte{telnetIAC, telnetDONT, opt})
+			} else {
+				t.reply([]byte{telnetIAC, telnetWONT, opt})
+			}
+			return
+		}
+		if t.enabled[key] {
+			return
+		}
+		t.enabled[key] = true
+		if verb == telnetWILL {
+			t.reply([]byte{telnetIAC, telnetDO, opt})
+		} else {
+			t.reply([]byte{telnetIAC, telnetWILL, opt})
+		}
+	case telnetWONT, telnetDONT:
+		if !t.enabled[key] {
+			return
+		}
+		t.enabled[key] = false
+		if verb == telnetWONT {
+			t.reply([]byte{telnetIAC, telnetDONT, opt})
+		} else {
+			t.reply([]byte{telnetIAC, telnetWONT, opt})
+		}
+	}
+}
+
+// subnegotiation will return com port reply for given command and value.
+func subnegotiation(cmd byte, value []byte) []byte {
+	out := []byte{telnetIAC, telnetSB, optComPort, cmd}
+	out = append(out, telnetescape(value)...)
+	return append(out, telnetIAC, telnetSE)
+}
+
+// telnetescape will double every IAC byte of data.
+func telnetescape(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for _, b := range data {
+		out = append(out, b)
+		if b == telnetIAC {
+			out = append(out, telnetIAC)
+		}
+	}
+	return out
+}
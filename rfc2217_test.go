@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// telnettest is telnet parser which keeps replies and com port commands.
+type telnettest struct {
+	*telnet
+	replies  []byte
+	commands [][]byte
+}
+
+func newtelnettest() *telnettest {
+	tt := &telnettest{}
+	tt.telnet = newtelnet(func(b []byte) { tt.replies = append(tt.replies, b...) },
+		func(cmd byte, data []byte) { tt.commands = append(tt.commands, append([]byte{cmd}, data...)) })
+	return tt
+}
+
+func TestTelnetData(t *testing.T) {
+	tt := newtelnettest()
+	got := tt.parse([]byte("show\r"))
+	got = append(got, tt.parse([]byte{'a', telnetIAC, telnetIAC, 'b', telnetIAC, 241, 'c', telnetIAC})...)
+	got = append(got, tt.parse([]byte{telnetIAC, 'd'})...)
+	if want := "show\ra\xffbc\xffd"; string(got) != want {
+		t.Errorf("data = %q, want %q", got, want)
+	}
+	if len(tt.replies) != 0 || len(tt.commands) != 0 {
+		t.Errorf("data made replies %v and commands %v", tt.replies, tt.commands)
+	}
+}
+
+func TestTelnetNegotiation(t *testing.T) {
+	tt := newtelnettest()
+	tt.parse([]byte{
+		telnetIAC, telnetWILL, optBinary,
+		// Second request of same option is not answered again.
+		telnetIAC, telnetWILL, optBinary,
+		telnetIAC, telnetDO, optEcho,
+		telnetIAC, telnetWILL, 24,
+		telnetIAC, telnetDO, 24,
+		// Option not enabled is not answered.
+		telnetIAC, telnetWONT, optSGA,
+		telnetIAC, telnetWONT, optBinary,
+	})
+	want := []byte{
+		telnetIAC, telnetDO, optBinary,
+		telnetIAC, telnetWILL, optEcho,
+		telnetIAC, telnetDONT, 24,
+		telnetIAC, telnetWONT, 24,
+		telnetIAC, telnetDONT, optBinary,
+	}
+	if !bytes.Equal(tt.replies, want) {
+		t.Errorf("replies = %v, want %v", tt.replies, want)
+	}
+}
+
+func TestTelnetStartEnablesOptions(t *testing.T) {
+	tt := newtelnettest()
+	tt.start()
+	tt.replies = nil
+	// Client agreeing to options server offered needs no answer.
+	tt.parse([]byte{telnetIAC, telnetDO, optBinary, telnetIAC, telnetWILL, optComPort})
+	if len(tt.replies) != 0 {
+		t.Errorf("replies to agreed options = %v", tt.replies)
+	}
+}
+
+func TestTelnetComPort(t *testing.T) {
+	tt := newtelnettest()
+	data := tt.parse([]byte{'a', telnetIAC, telnetSB, optComPort, cpSetBaudrate, 0, 1, 0xc2})
+	data = append(data, tt.parse([]byte{0, telnetIAC, telnetSE, 'b'})...)
+	// IAC in value is doubled.
+	tt.parse([]byte{telnetIAC, telnetSB, optComPort, cpSetControl, telnetIAC, telnetIAC, telnetIAC, telnetSE})
+	// Subnegotiation of other option is ignored.
+	tt.parse([]byte{telnetIAC, telnetSB, 24, 1, telnetIAC, telnetSE})
+	if string(data) != "ab" {
+		t.Errorf("data = %q, want %q", data, "ab")
+	}
+	want := [][]byte{{cpSetBaudrate, 0, 1, 0xc2, 0}, {cpSetControl, telnetIAC}}
+	if len(tt.commands) != len(want) {
+		t.Fatalf("commands = %v, want %v", tt.commands, want)
+	}
+	for index := range want {
+		if !bytes.Equal(tt.commands[index], want[index]) {
+			t.Errorf("command %d = %v, want %v", index, tt.commands[index], want[index])
+		}
+	}
+}
+
+func TestSubnegotiation(t *testing.T) {
+	got := subnegotiation(cpSetDatasize+cpServerOffset, []byte{8, telnetIAC})
+	want := []byte{telnetIAC, telnetSB, optComPort, cpSetDatasize + cpServerOffset, 8, telnetIAC, telnetIAC,
+		telnetIAC, telnetSE}
+	if !bytes.Equal(got, want) {
+		t.Errorf("subnegotiation = %v, want %v", got, want)
+	}
+}
+
+func TestTelnetLongSubnegotiation(t *testing.T) {
+	tt := newtelnettest()
+	in := append([]byte{telnetIAC, telnetSB, optComPort, cpSetBaudrate}, bytes.Repeat([]byte{1}, 10*maxsb)...)
+	in = append(in, telnetIAC, telnetSE, 'x')
+	if data := tt.parse(in); string(data) != "x" {
+		t.Errorf("data after long subnegotiation = %q", data)
+	}
+	if len(tt.commands) != 0 || cap(tt.sb) > 2*maxsb {
+		t.Errorf("long subnegotiation kept, commands %v, buffer %d", tt.commands, cap(tt.sb))
+	}
+	// Next subnegotiation is not dropped.
+	tt.parse([]byte{telnetIAC, telnetSB, optComPort, cpPurgeData, 3, telnetIAC, telnetSE})
+	if len(tt.commands) != 1 || !bytes.Equal(tt.commands[0], []byte{cpPurgeData, 3}) {
+		t.Errorf("commands after long subnegotiation = %v", tt.commands)
+	}
+}
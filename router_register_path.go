@@ -19,9 +19,8 @@ var (
 	upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+		// Page of other site must not open console with cookie of user.
+		CheckOrigin: sameorigin,
 	}
 	// Binary directory path
 	absPath string
@@ -31,23 +30,48 @@ var (
 	writeWait  = 10 * time.Second
 )
 
+// markers around scrollback replayed to new websocket session.
+const (
+	replayStart = "\x1b[7m--- scrollback ---\x1b[0m\r\n"
+	replayEnd   = "\r\n\x1b[7m--- end of scrollback, live output follows ---\x1b[0m\r\n"
+)
+
 // registerPaths will register all paths at one go.
 func registerPaths(r *mux.Router) {
 	staticDir := "/ui/"
 	r.PathPrefix(staticDir).Handler(http.StripPrefix(staticDir, http.FileServer(http.Dir(absPath+staticDir))))
-	fs := http.FileServer(http.Dir(config.Logs.Inlogs))
-	r.PathPrefix("/logs/").Handler(http.StripPrefix("/logs/", fileserve(fs)))
-	r.HandleFunc("/serialconsole", webSocketHandler).Queries("portname", "{.*}")
+	r.HandleFunc("/logs/search", searchLogs).Methods("GET")
+	r.HandleFunc("/logs/export", exportLogs).Methods("GET")
+	r.PathPrefix("/logs/").Handler(http.StripPrefix("/logs/", fileserve()))
+	r.HandleFunc("/serialconsole", withrole(roleViewer, webSocketHandler)).Queries("portname", "{.*}")
 	r.HandleFunc("/get/config", getConfig).Methods("GET")
 	r.HandleFunc("/port", servePortHtml).Methods("GET")
+	r.HandleFunc("/replay", serveReplayHtml).Methods("GET")
+	r.HandleFunc("/recordings", getRecordings).Methods("GET")
 	r.HandleFunc("/", serveHomeHtml).Methods("GET")
-	r.HandleFunc("/delete", deletePort).Methods("DELETE").Queries("portname", "{.*}")
-	r.HandleFunc("/edit", editPort).Methods("POST").Queries("portname", "{.*}")
-	r.HandleFunc("/add", addPort).Methods("POST")
-	r.HandleFunc("/stop", stopPort).Methods("POST").Queries("portname", "{.*}")
-	r.HandleFunc("/start", startPort).Methods("POST").Queries("portname", "{.*}")
-	r.HandleFunc("/getactivesession", getActiveSession).Methods("GET").Queries("portname", "{.*}")
+	r.HandleFunc("/delete", withconfigchange(withaudit("port.delete", withrole(roleAdmin, deletePort)))).Methods("DELETE").Queries("portname", "{.*}")
+	r.HandleFunc("/edit", withconfigchange(withaudit("port.edit", withrole(roleAdmin, editPort)))).Methods("POST").Queries("portname", "{.*}")
+	r.HandleFunc("/add", withconfigchange(withaudit("port.add", withrole(roleAdmin, addPort)))).Methods("POST")
+	r.HandleFunc("/stop", withconfigchange(withaudit("port.stop", withrole(roleOperator, stopPort)))).Methods("POST").Queries("portname", "{.*}")
+	r.HandleFunc("/start", withconfigchange(withaudit("port.start", withrole(roleOperator, startPort)))).Methods("POST").Queries("portname", "{.*}")
+	r.HandleFunc("/getactivesession", withrole(roleViewer, getActiveSession)).Methods("GET").Queries("portname", "{.*}")
 	r.HandleFunc("/version", serveVersion).Methods("GET")
+	r.HandleFunc("/audit", getAudit).Methods("GET")
+	r.HandleFunc("/config/backups", withrole(roleAdmin, getConfigBackups)).Methods("GET")
+	r.HandleFunc("/config/rollback", withaudit("config.rollback", withrole(roleAdmin, rollbackConfig))).Methods("POST").Queries("backup", "{.*}")
+	r.HandleFunc("/discover", withrole(roleAdmin, discoverPorts)).Methods("GET")
+	r.HandleFunc("/metrics", getMetrics).Methods("GET")
+	r.HandleFunc("/healthz", getHealthz).Methods("GET")
+	r.HandleFunc("/readyz", getReadyz).Methods("GET")
+	r.HandleFunc("/ports", getPorts).Methods("GET")
+	r.HandleFunc("/ports/{name:.+}/status", getPortStatus).Methods("GET")
+	r.HandleFunc("/ports/{name:.+}/scripts/run", runScript).Methods("POST")
+	r.HandleFunc("/ports/{name:.+}/jobs/{job}/run", runJob).Methods("POST")
+	r.HandleFunc("/ports/{name:.+}/jobs/{job}/history", getJobHistory).Methods("GET")
+	r.HandleFunc("/ports/{name:.+}/jobs/{job}", withconfigchange(deleteJob)).Methods("DELETE")
+	r.HandleFunc("/ports/{name:.+}/jobs", getJobs).Methods("GET")
+	r.HandleFunc("/ports/{name:.+}/jobs", withconfigchange(setJob)).Methods("POST")
+	r.Use(csrfmiddleware, authmiddleware)
 }
 
 // getActiveSession will return active session count on givne port
@@ -83,8 +107,8 @@ func startPort(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(msg))
 		return
 	}
-	all.ports[pname].clientactive.increment(r.RemoteAddr)
-	defer all.ports[pname].clientactive.decrement()
+	s := all.ports[pname].clientactive.attach(r.RemoteAddr, username(r), "api")
+	defer all.ports[pname].clientactive.detach(s)
 	if st, _ := config.getStatus(pname); st == 1 {
 		return
 	}
@@ -93,12 +117,8 @@ func startPort(w http.ResponseWriter, r *http.Request) {
 	}
 	_ = config.portStatusUpdate(pname, 1)
 	_ = all.portStatusUpdate(pname, 1)
-	err := config.writeYaml(*conf)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Error writing YAML file."))
-		log.Panicf("[Client:" + r.RemoteAddr + " Serial Port:" + "]" + pname + err.Error())
-		return
+	if err := config.writeYaml(*conf); err != nil {
+		configerror(w, r, pname, err)
 	}
 	initializereader(pname)
 }
@@ -112,48 +132,37 @@ func stopPort(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(msg))
 		return
 	}
-	all.ports[pname].clientactive.increment(r.RemoteAddr)
-	defer all.ports[pname].clientactive.decrement()
+	s := all.ports[pname].clientactive.attach(r.RemoteAddr, username(r), "api")
+	defer all.ports[pname].clientactive.detach(s)
 	if st, _ := config.getStatus(pname); st == 2 {
 		return
 	}
 	if st, _ := all.getStatus(pname); st == 2 {
 		return
 	}
-	_ = mainReaderClose(pname)
+	if err := all.ports[pname].stopreader(); err != nil {
+		log.Printf("[Client:%s Serial Port:%s]Error stopping main reader: %s",
+			r.RemoteAddr, pname, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
 	log.Printf("[Client:%s Serial Port:%s]Main reader go routine closed.",
 		r.RemoteAddr, pname)
 	config.portStatusUpdate(pname, 2)
-	all.mu.Lock()
-	tmp := all.ports[pname].baudrate
-	all.mu.Unlock()
-	all.initializeport(pname, tmp, 2)
-	err := config.writeYaml(*conf)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Error writing YAML file."))
-		log.Panicf("[Client:" + r.RemoteAddr + " Serial Port:" + "]" + pname + err.Error())
-		return
+	tmp, _ := config.getElement(pname)
+	all.initializeport(tmp)
+	if err := config.writeYaml(*conf); err != nil {
+		configerror(w, r, pname, err)
 	}
 }
 
-// mainReaderClose will close main reader go routine and return
-func mainReaderClose(portname string) bool {
-	for {
-		select {
-		case <-all.ports[portname].ack:
-			log.Printf("[Port:%s]Mainreader go routine closed. Ack recived.", portname)
-			return true
-		default:
-			all.ports[portname].stop <- struct{}{}
-			log.Printf("[Port:%s]Mainreader go routine stop send.", portname)
-			// Not needed anymore as we have added timeout on port read and it is non blocking.
-			// if all.ports[portname].port != nil {
-			// 	all.ports[portname].port.Write([]byte("golang\n"))
-			// }
-			time.Sleep(200 * time.Millisecond)
-		}
-	}
+// configerror will report failed config file write to client. Change is
+// already applied to running service but is lost on restart.
+func configerror(w http.ResponseWriter, r *http.Request, pname string, err error) {
+	log.Printf("[Client:%s Serial Port:%s]Error writing config file: %s", r.RemoteAddr, pname, err)
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte("Change is applied but config file could not be written: " + err.Error()))
 }
 
 // commonCheck function will check common condition for delete/edit request of API
@@ -176,9 +185,10 @@ func commonCheck(pname string) (string, int) {
 
 	// check if there are any other existing session active or not.
 	// and lock session on this port any more.
-	if all.ports[pname].clientactive.getconncount() >= 1 {
-		msg := "Can not delete/edit/stop/start port .One session active with IP:" +
-			all.ports[pname].clientactive.getraaddr() + ".Try after sometime."
+	if count := all.ports[pname].clientactive.getconncount(); count >= 1 {
+		msg := "Can not delete/edit/stop/start port. " + strconv.Itoa(count) +
+			" session(s) active, one with IP:" + all.ports[pname].clientactive.getraaddr() +
+			". Try after sometime."
 		return msg, http.StatusForbidden
 	}
 	return "", http.StatusOK
@@ -196,7 +206,7 @@ func (p *jsonport) jsondecoder(r *http.Request) error {
 	return nil
 }
 
-// editPort will delete port configuration if portname or baudrate changing
+// editPort will delete port configuration if portname or line settings changing
 // if only desc is changing then port deletion not required.
 func editPort(w http.ResponseWriter, r *http.Request) {
 	var pname = r.FormValue("portname")
@@ -208,43 +218,69 @@ func editPort(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	line := jport.lineconfig()
+	if err = line.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
 	msg, status := commonCheck(pname)
 	if msg != "" {
 		w.WriteHeader(status)
 		w.Write([]byte(msg))
 		return
 	}
-	all.ports[pname].clientactive.increment(r.RemoteAddr)
+	oldpc, _ := config.getElement(pname)
+	newpc := jport.portconfig(oldpc)
+	if line == oldpc.lineconfig && jport.Newname == pname {
+		// Only description changes, status of port is kept.
+		newpc = oldpc
+		newpc.Desc = jport.Desc
+	}
+	if err = config.checkport(pname, newpc); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	sp := all.ports[pname]
+	s := sp.clientactive.attach(r.RemoteAddr, username(r), "api")
+	// Port may be removed and added again under new name, session is of
+	// old one.
+	defer sp.clientactive.detach(s)
 	all.mu.Lock()
-	tmpbr := all.ports[pname].baudrate
+	tmpline := all.ports[pname].line
 	all.mu.Unlock()
-	if jport.Baudrate == tmpbr && jport.Newname == pname {
+	if line == tmpline && jport.Newname == pname {
 		err = config.updateElement(jport.Newname, jport.Desc)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte(err.Error()))
 			return
 		}
-		err = config.writeYaml(*conf)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("Some error while writing YAML.Service going into panic..."))
-			log.Panicf(err.Error())
+		if err = config.writeYaml(*conf); err != nil {
+			configerror(w, r, pname, err)
 		}
-		all.ports[pname].clientactive.decrement()
 	} else {
-		if jport.Baudrate == tmpbr && (all.checkElement(jport.Newname) ||
+		if jport.Newname != pname && (all.checkElement(jport.Newname) ||
 			config.checkElement(jport.Newname)) {
-			all.ports[pname].clientactive.decrement()
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte("Provided port name already exist."))
 			return
 		}
-		if st, _ := all.getStatus(pname); st == 1 {
-			mainReaderClose(pname)
-			log.Printf("[Client:%s Serial Port:%s]Main reader go routine closed.",
-				r.RemoteAddr, pname)
+		if tcp := config.tcpserver(pname); jport.Newname != pname && tcp != 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Port is served by tcp server " + strconv.Itoa(tcp) + ", can not rename it."))
+			return
 		}
+		if err = all.ports[pname].stopreader(); err != nil {
+			log.Printf("[Client:%s Serial Port:%s]Error stopping main reader: %s",
+				r.RemoteAddr, pname, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		log.Printf("[Client:%s Serial Port:%s]Main reader go routine closed.",
+			r.RemoteAddr, pname)
 
 		all.removeElement(pname)
 		log.Printf("[Client:%s Serial Port:%s]Port removed from allports struct.",
@@ -254,27 +290,27 @@ func editPort(w http.ResponseWriter, r *http.Request) {
 		log.Printf("[Client:%s Serial Port:%s]Port removed from config struct.",
 			r.RemoteAddr, pname)
 
-		err = all.addnewport(jport.Newname, jport.Baudrate, 1)
+		err = all.addnewport(newpc)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte(err.Error()))
 			return
 		}
-		err = config.addElement(jport.Newname, jport.Baudrate, jport.Desc)
+		err = config.addElement(newpc)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte(err.Error()))
 			return
 		}
 
-		err = config.writeYaml(*conf)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("Service going into panic. Start again..."))
-			log.Panicf("[Client:" + r.RemoteAddr + " Serial Port:" + "]" + pname + err.Error())
+		if err = config.writeYaml(*conf); err != nil {
+			configerror(w, r, jport.Newname, err)
+		} else {
+			log.Printf("[Client:%s Serial Port:%s]New port added to YAML.",
+				r.RemoteAddr, jport.Newname)
 		}
-		log.Printf("[Client:%s Serial Port:%s]New port added to YAML.",
-			r.RemoteAddr, jport.Newname)
+		// jobs follow renamed port.
+		syncjobs()
 		// start newly added port.
 		initializereader(jport.Newname)
 	}
@@ -291,6 +327,14 @@ func addPort(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	line := jport.lineconfig()
+	if err = line.validate(); err != nil {
+		log.Printf("[Client:%s Serial Port:%s]Invalid line settings:%s",
+			r.RemoteAddr, jport.Newname, err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
 	if all.checkElement(jport.Newname) && config.checkElement(jport.Newname) {
 		log.Printf("[Client:%s Serial Port:%s]Given port already exist.",
 			r.RemoteAddr, jport.Newname)
@@ -299,27 +343,33 @@ func addPort(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = all.addnewport(jport.Newname, jport.Baudrate, 1)
+	newpc := jport.portconfig(port{})
+	if err = config.checkport("", newpc); err != nil {
+		log.Printf("[Client:%s Serial Port:%s]Invalid port config:%s",
+			r.RemoteAddr, jport.Newname, err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	err = all.addnewport(newpc)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
 	}
-	err = config.addElement(jport.Newname, jport.Baudrate, jport.Desc)
+	err = config.addElement(newpc)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
-	err = config.writeYaml(*conf)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Service going into panic. Start again..."))
-		log.Panicf("[Client:" + r.RemoteAddr + " Serial Port:" + "]" + jport.Newname + err.Error())
+	if err = config.writeYaml(*conf); err != nil {
+		configerror(w, r, jport.Newname, err)
+	} else {
+		log.Printf("[Client:%s Serial Port:%s]New port added to YAML.",
+			r.RemoteAddr, jport.Newname)
 	}
-	log.Printf("[Client:%s Serial Port:%s]New port added to YAML.",
-		r.RemoteAddr, jport.Newname)
 	// start newly added port.
 	initializereader(jport.Newname)
 }
@@ -334,13 +384,24 @@ func deletePort(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(msg))
 		return
 	}
-	all.ports[pname].clientactive.increment(r.RemoteAddr)
+	if tcp := config.tcpserver(pname); tcp != 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Port is served by tcp server " + strconv.Itoa(tcp) + ", can not delete it."))
+		return
+	}
+	sp := all.ports[pname]
+	s := sp.clientactive.attach(r.RemoteAddr, username(r), "api")
+	defer sp.clientactive.detach(s)
 
-	if st, _ := all.getStatus(pname); st == 1 {
-		_ = mainReaderClose(pname)
-		log.Printf("[Client:%s Serial Port:%s]Main reader go routine closed.",
-			r.RemoteAddr, pname)
+	if err := sp.stopreader(); err != nil {
+		log.Printf("[Client:%s Serial Port:%s]Error stopping main reader: %s",
+			r.RemoteAddr, pname, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
 	}
+	log.Printf("[Client:%s Serial Port:%s]Main reader go routine closed.",
+		r.RemoteAddr, pname)
 
 	_ = all.removeElement(pname)
 	log.Printf("[Client:%s Serial Port:%s]Port removed from allports struct.",
@@ -349,18 +410,37 @@ func deletePort(w http.ResponseWriter, r *http.Request) {
 	_ = config.removeElement(pname)
 	log.Printf("[Client:%s Serial Port:%s]Port removed from config struct.",
 		r.RemoteAddr, pname)
+	syncjobs()
 
-	err := config.writeYaml(*conf)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Error writing YAML file."))
-		log.Panicf("[Client:" + r.RemoteAddr + " Serial Port:" + "]" + pname + err.Error())
+	if err := config.writeYaml(*conf); err != nil {
+		configerror(w, r, pname, err)
 	}
 }
 
-// serve static log files
-func fileserve(fs http.Handler) http.HandlerFunc {
+// serve static log files, port logs need viewer role on port, files with
+// data of every port like audit log need admin role on all ports and other
+// files like agent logs need viewer role on all ports. Logs dir is taken on
+// every request as reload can change it.
+func fileserve() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		config.mu.Lock()
+		fs := http.FileServer(http.Dir(config.Logs.Inlogs))
+		config.mu.Unlock()
+		if adminfile(r.URL.Path) {
+			if !authorize(w, r, "*", roleAdmin) {
+				return
+			}
+			w.Header().Set("Content-Type", "text/x-info")
+			fs.ServeHTTP(w, r)
+			return
+		}
+		pname := logport(r.URL.Path)
+		if pname == "" {
+			pname = "*"
+		}
+		if !authorize(w, r, pname, roleViewer) {
+			return
+		}
 		w.Header().Set("Content-Type", "text/x-info")
 		fs.ServeHTTP(w, r)
 	}
@@ -389,8 +469,11 @@ func servePortHtml(w http.ResponseWriter, r *http.Request) {
 }
 
 // getConfig will return configuration of yaml file into JSON format
+// with ports user of request can view.
 func getConfig(w http.ResponseWriter, r *http.Request) {
-	str, err := config.getJSON()
+	str, err := config.getJSON(func(pname string) bool {
+		return portrole(r, pname) >= roleViewer
+	})
 	if err != nil {
 		log.Printf("Error in JSON Marshal: %s", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -399,11 +482,25 @@ func getConfig(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// control struct is JSON control message sent by websocket client as text
+// message. Console input is always sent as binary message. Type is one of
+// request, takeover, release, secret or resize with terminal size.
+type control struct {
+	Type string `json:"type"`
+	Cols int    `json:"cols,omitempty"`
+	Rows int    `json:"rows,omitempty"`
+}
+
 // webSocket handler handles any request to access serial port
-// over websocket connection
+// over websocket connection. Any number of clients can watch port, only
+// client holding write role can write to port.
 func webSocketHandler(w http.ResponseWriter, r *http.Request) {
 	var raddr = r.RemoteAddr
 	var pname = r.FormValue("portname")
+	var user = username(r)
+	// viewers can only watch, operators can write to port.
+	var canwrite = portrole(r, pname) >= roleOperator
+	var viewonly = r.FormValue("mode") == "view" || !canwrite
 	log.Printf("[Client:%s Serial Port:%s]Starting session",
 		raddr, pname)
 	done := make(chan struct{}, 2)
@@ -424,33 +521,46 @@ func webSocketHandler(w http.ResponseWriter, r *http.Request) {
 		conn.WriteMessage(websocket.BinaryMessage, []byte("Please enable port first from UI."))
 		return
 	}
-	// Checking existing number of session and allow or disallow new
-	// session.
-	if all.ports[pname].clientactive.getconncount() >= 1 {
-		msg := "One user session already active with IP:" + all.ports[pname].clientactive.getraaddr() + "."
-		conn.WriteMessage(websocket.BinaryMessage, []byte(msg))
-		log.Printf("[Client:%s Serial Port:%s]Session not allowed.", raddr, pname)
-		return
-	} else {
-		// p.ports[pname].clientactive.increment(raddr)
-		log.Printf("[Client:%s Serial Port:%s]Session allowed. Active session count: %d",
-			raddr, pname, all.ports[pname].clientactive.getconncount())
-		all.ports[pname].clientactive.increment(raddr)
-	}
 
 	// Checking if port is already open and if not open then return
 	// without opening any port read/write.
 	all.mu.Lock()
 	if all.ports[pname].port == nil {
 		all.mu.Unlock()
-		all.ports[pname].clientactive.decrement()
 		msg := "Port is not yet opened. Please connect port and try again."
 		conn.WriteMessage(websocket.BinaryMessage, []byte(msg))
 		log.Printf("[Client:%s Serial Port:%s]Error: %s",
 			raddr, pname, msg)
 		return
 	}
+	sp := all.ports[pname]
 	all.mu.Unlock()
+
+	s := sp.clientactive.attach(raddr, user, "websocket")
+	auditsession(s, pname, "session.start")
+	var rec *castrecorder
+	if pc, err := config.getElement(pname); err == nil && pc.Recordsession == 1 {
+		if rec, err = newcastrecorder(pname, s, time.Now()); err != nil {
+			log.Printf("[Client:%s Serial Port:%s]Session not recorded: %s", raddr, pname, err)
+		} else {
+			log.Printf("[Client:%s Serial Port:%s]Recording session to %s", raddr, pname, rec.name)
+			defer rec.close()
+		}
+	}
+	if !viewonly {
+		sp.clientactive.trywrite(s)
+	}
+	sub, replay := sp.comm.subscribe()
+	defer sp.comm.unsubscribe(sub)
+	if len(replay) > 0 {
+		conn.SetWriteDeadline(time.Now().Add(writeWait))
+		conn.WriteMessage(websocket.BinaryMessage, []byte(replayStart))
+		conn.WriteMessage(websocket.BinaryMessage, replay)
+		conn.WriteMessage(websocket.BinaryMessage, []byte(replayEnd))
+	}
+	log.Printf("[Client:%s Serial Port:%s]Session allowed. Active session count: %d",
+		raddr, pname, sp.clientactive.getconncount())
+
 	// goroutine to read from port and write to websocket
 	go func() {
 		ticker := time.NewTicker(pingPeriod)
@@ -461,21 +571,35 @@ func webSocketHandler(w http.ResponseWriter, r *http.Request) {
 		}()
 		for {
 			select {
-			case v, ok := <-all.ports[pname].comm:
-				if !ok {
-					log.Printf("[Client:%s Serial Port:%s]Comm channel is closed.",
-						raddr, pname)
+			case v := <-sub.ch:
+				conn.SetWriteDeadline(time.Now().Add(writeWait))
+				err := conn.WriteMessage(websocket.BinaryMessage, v)
+				if err != nil {
+					sp.stats.add(&sp.stats.wserrors, 1)
+					log.Printf("[Client:%s Serial Port:%s]Write error %s\n",
+						raddr, pname, err)
 					done <- struct{}{}
 					return
 				}
+				rec.output(v, time.Now())
+			case v := <-s.events:
 				conn.SetWriteDeadline(time.Now().Add(writeWait))
-				err := conn.WriteMessage(websocket.BinaryMessage, []byte(v)[:len([]byte(v))])
+				err := conn.WriteMessage(websocket.TextMessage, v)
 				if err != nil {
+					sp.stats.add(&sp.stats.wserrors, 1)
 					log.Printf("[Client:%s Serial Port:%s]Write error %s\n",
 						raddr, pname, err)
 					done <- struct{}{}
 					return
 				}
+			case reason := <-s.closed:
+				log.Printf("[Client:%s Serial Port:%s]Closing session: %s",
+					raddr, pname, reason)
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, reason),
+					time.Now().Add(writeWait))
+				done <- struct{}{}
+				return
 			case <-ticker.C:
 				conn.SetWriteDeadline(time.Now().Add(writeWait))
 				if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
@@ -493,10 +617,12 @@ func webSocketHandler(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if r := recover(); r != nil {
 				log.Printf("[Client:%s Serial Port:%s]Panic writing to port: %s.",
-					raddr, pname, err)
+					raddr, pname, r)
 				done <- struct{}{}
 			}
-			all.ports[pname].clientactive.decrement()
+			sp.clientactive.detach(s)
+			sp.capture.endinput(s.who())
+			auditsession(s, pname, "session.end")
 			log.Printf("[Client:%s Serial Port:%s]Go routine read from ws closed.",
 				raddr, pname)
 		}()
@@ -506,18 +632,46 @@ func webSocketHandler(w http.ResponseWriter, r *http.Request) {
 			return nil
 		})
 		for {
-			_, reader, err := conn.ReadMessage()
+			mt, reader, err := conn.ReadMessage()
 			if err != nil {
 				log.Printf("[Client:%s Serial Port:%s]Error reading: %s.",
 					raddr, pname, err)
 				break
 			}
-			_, err = all.ports[pname].port.Write(reader)
+			if mt == websocket.TextMessage {
+				var c control
+				if json.Unmarshal(reader, &c) == nil && c.Type != "" {
+					switch c.Type {
+					case "resize":
+						rec.resize(c.Cols, c.Rows, time.Now())
+						continue
+					case "secret":
+						rec.secretinput()
+					}
+					if canwrite {
+						sessioncontrol(sp, s, c)
+					}
+					continue
+				}
+			}
+			if !sp.clientactive.iswriter(s) {
+				continue
+			}
+			p := sp.getport()
+			if p == nil {
+				log.Printf("[Client:%s Serial Port:%s]Port is closed.", raddr, pname)
+				break
+			}
+			n, err := p.Write(reader)
+			sp.stats.add(&sp.stats.writtenbytes, n)
 			if err != nil {
+				sp.stats.add(&sp.stats.writeerrors, 1)
 				log.Printf("[Client:%s Serial Port:%s]Error writing to port: %s.",
 					raddr, pname, err)
 				break
 			}
+			sp.capture.input(s.who(), reader, time.Now())
+			rec.input(reader, time.Now())
 		}
 		done <- struct{}{}
 	}()
@@ -526,6 +680,27 @@ func webSocketHandler(w http.ResponseWriter, r *http.Request) {
 	<-done
 }
 
+// sessioncontrol will handle control message of websocket session.
+func sessioncontrol(sp *serialport, s *session, c control) {
+	switch c.Type {
+	case "request":
+		sp.clientactive.requestwrite(s, false)
+	case "takeover":
+		sp.clientactive.requestwrite(s, true)
+		auditsession(s, sp.name, "session.takeover")
+		log.Printf("[Client:%s Serial Port:%s]Write role taken over.", s.raddr, sp.name)
+	case "secret":
+		// Next line typed by session is not recorded in capture log.
+		sp.capture.secret(s.who())
+	case "release":
+		sp.clientactive.release(s)
+		auditsession(s, sp.name, "session.release")
+	default:
+		log.Printf("[Client:%s Serial Port:%s]Unknown control message:%s",
+			s.raddr, sp.name, c.Type)
+	}
+}
+
 // CreateRouterRegisterPaths will be exported and will create router and register paths.
 func createRouterRegisterPaths() *mux.Router {
 	path, err := os.Executable()
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// script limits and defaults.
+const (
+	defaultScriptTimeout = 10 * time.Minute
+	defaultExpectTimeout = 30 * time.Second
+	// maxscriptsteps stops scripts looping forever with goto.
+	maxscriptsteps = 10000
+	// maxexpectbuffer is unmatched output kept for expect, older is dropped.
+	maxexpectbuffer = 64 * 1024
+	// maxscriptoutput is port output kept in result of run.
+	maxscriptoutput = 1024 * 1024
+)
+
+// script run status.
+const (
+	scriptOk      = "ok"
+	scriptFailed  = "failed"
+	scriptAborted = "aborted"
+)
+
+// duration is time.Duration written as string like 10s in JSON and YAML.
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return errors.New("duration must be string like 10s")
+	}
+	v, err := time.ParseDuration(s)
+	*d = duration(v)
+	return err
+}
+
+func (d duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d *duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	*d = duration(v)
+	return err
+}
+
+// script is expect style automation run against live output of port.
+// Steps run in order, goto and cases of expect jump to labels.
+type script struct {
+	Name string `yaml:"name,omitempty" json:"name,omitempty"`
+	// Vars are initial variables, ${name} in send and expect is replaced by
+	// value and capture of expect sets them.
+	Vars map[string]string `yaml:"vars,omitempty" json:"vars,omitempty"`
+	// Timeout bounds whole run, default 10m.
+	Timeout duration     `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	Steps   []scriptstep `yaml:"steps" json:"steps"`
+}
+
+// scriptstep is one step of script, exactly one of label, send, expect,
+// cases, sleep, goto or fail is set.
+type scriptstep struct {
+	Label string `yaml:"label,omitempty" json:"label,omitempty"`
+	Send  string `yaml:"send,omitempty" json:"send,omitempty"`
+	// Expect is regex waited for in output since last match.
+	Expect string `yaml:"expect,omitempty" json:"expect,omitempty"`
+	// Cases wait for first of regexes and branch to its label.
+	Cases []scriptcase `yaml:"cases,omitempty" json:"cases,omitempty"`
+	Sleep duration     `yaml:"sleep,omitempty" json:"sleep,omitempty"`
+	Goto  string       `yaml:"goto,omitempty" json:"goto,omitempty"`
+	Fail  string       `yaml:"fail,omitempty" json:"fail,omitempty"`
+	// Timeout of expect or cases, default 30s.
+	Timeout duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	// Capture is variable set to first group of expect match, or whole
+	// match if regex has no group.
+	Capture string `yaml:"capture,omitempty" json:"capture,omitempty"`
+	// Ontimeout is label to go to when expect times out, otherwise script
+	// fails.
+	Ontimeout string `yaml:"ontimeout,omitempty" json:"ontimeout,omitempty"`
+}
+
+// scriptcase is branch of cases step.
+type scriptcase struct {
+	Regex string `yaml:"regex" json:"regex"`
+	// Goto is label to continue at, next step if empty.
+	Goto    string `yaml:"goto,omitempty" json:"goto,omitempty"`
+	Capture string `yaml:"capture,omitempty" json:"capture,omitempty"`
+}
+
+// scriptresult is outcome of script run.
+type scriptresult struct {
+	Name   string            `json:"name,omitempty"`
+	Status string            `json:"status"`
+	Error  string            `json:"error,omitempty"`
+	Vars   map[string]string `json:"vars,omitempty"`
+	Start  time.Time         `json:"start"`
+	End    time.Time         `json:"end"`
+	// output is port output read during run, capped at maxscriptoutput.
+	output []byte
+}
+
+// scriptvar matches ${name} reference in send and expect.
+var scriptvar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// check will add problems of script at given path to errs.
+func (sc *script) check(path string, errs *configerrors) {
+	if len(sc.Steps) == 0 {
+		errs.add(path+".steps", "at least one step is needed")
+	}
+	if sc.Timeout < 0 {
+		errs.add(path+".timeout", "must not be negative")
+	}
+	labels := make(map[string]bool)
+	for index, st := range sc.Steps {
+		if st.Label == "" {
+			continue
+		}
+		if labels[st.Label] {
+			errs.add(fmt.Sprintf("%s.steps[%d].label", path, index), "duplicate label %s", st.Label)
+		}
+		labels[st.Label] = true
+	}
+	golabel := func(p string, label string) {
+		if label != "" && !labels[label] {
+			errs.add(p, "unknown label %s", label)
+		}
+	}
+	regex := func(p string, re string) {
+		if re == "" {
+			errs.add(p, "must not be empty")
+		} else if _, err := regexp.Compile(scriptvar.ReplaceAllString(re, "")); err != nil {
+			errs.add(p, "%s", err)
+		}
+	}
+	for index, st := range sc.Steps {
+		spath := fmt.Sprintf("%s.steps[%d]", path, index)
+		kinds := 0
+		for _, set := range []bool{st.Label != "", st.Send != "", st.Expect != "", len(st.Cases) > 0,
+			st.Sleep != 0, st.Goto != "", st.Fail != ""} {
+			if set {
+				kinds++
+			}
+		}
+		if kinds != 1 {
+			errs.add(spath, "exactly one of label, send, expect, cases, sleep, goto or fail is needed")
+			continue
+		}
+		switch {
+		case st.Expect != "":
+			regex(spath+".expect", st.Expect)
+		case len(st.Cases) > 0:
+			for cindex, c := range st.Cases {
+				cpath := fmt.Sprintf("%s.cases[%d]", spath, cindex)
+				regex(cpath+".regex", c.Regex)
+				golabel(cpath+".goto", c.Goto)
+			}
+		case st.Sleep < 0:
+			errs.add(spath+".sleep", "must not be negative")
+		case st.Goto != "":
+			golabel(spath+".goto", st.Goto)
+		}
+		if st.Timeout < 0 {
+			errs.add(spath+".timeout", "must not be negative")
+		}
+		golabel(spath+".ontimeout", st.Ontimeout)
+	}
+}
+
+// transcript will write progress of script run to caller, as text with
+// steps on lines starting with ### or as JSON lines.
+type transcript struct {
+	w     io.Writer
+	flush func()
+	json  bool
+	// midline is true if last output did not end with newline.
+	midline bool
+}
+
+// transcriptline is JSON line of transcript.
+type transcriptline struct {
+	Time   time.Time     `json:"time"`
+	Type   string        `json:"type"`
+	Data   string        `json:"data,omitempty"`
+	Result *scriptresult `json:"result,omitempty"`
+}
+
+func (t *transcript) writeline(l transcriptline) {
+	b, _ := json.Marshal(l)
+	t.w.Write(append(b, '\n'))
+}
+
+// output will write port output read during run.
+func (t *transcript) output(data []byte) {
+	if t.json {
+		t.writeline(transcriptline{Time: time.Now().UTC(), Type: "output", Data: string(data)})
+	} else {
+		t.w.Write(data)
+		t.midline = data[len(data)-1] != '\n'
+	}
+	t.flush()
+}
+
+// step will write progress message of script.
+func (t *transcript) step(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if t.json {
+		t.writeline(transcriptline{Time: time.Now().UTC(), Type: "step", Data: msg})
+	} else {
+		if t.midline {
+			t.w.Write([]byte("\n"))
+			t.midline = false
+		}
+		t.w.Write([]byte("### " + msg + "\n"))
+	}
+	t.flush()
+}
+
+// result will write outcome of run as last line.
+func (t *transcript) result(res scriptresult) {
+	if t.json {
+		t.writeline(transcriptline{Time: res.End, Type: "result", Result: &res})
+		t.flush()
+		return
+	}
+	msg := "result: " + res.Status
+	if res.Error != "" {
+		msg = msg + ": " + res.Error
+	}
+	t.step("%s", msg)
+}
+
+// scriptrun is state of running script.
+type scriptrun struct {
+	sp   *serialport
+	s    *session
+	sub  *subscriber
+	vars map[string]string
+	// buf is output not consumed by expect yet.
+	buf []byte
+	out *transcript
+	res *scriptresult
+}
+
+// errscripttimeout is returned by wait when expect timed out.
+var errscripttimeout = errors.New("expect timed out")
+
+// aborterror is error which ends run as aborted rather than failed.
+type aborterror struct {
+	reason string
+}
+
+func (e aborterror) Error() string {
+	return e.reason
+}
+
+// runscript will run script on port as session s, which must hold write
+// role and subscriber sub of port output. Progress is written to out.
+func runscript(ctx context.Context, sp *serialport, s *session, sub *subscriber, sc *script, out *transcript) scriptresult {
+	res := scriptresult{Name: sc.Name, Status: scriptOk, Vars: make(map[string]string), Start: time.Now().UTC()}
+	for k, v := range sc.Vars {
+		res.Vars[k] = v
+	}
+	timeout := time.Duration(sc.Timeout)
+	if timeout == 0 {
+		timeout = defaultScriptTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	run := &scriptrun{sp: sp, s: s, sub: sub, vars: res.Vars, out: out, res: &res}
+	err := run.steps(ctx, sc)
+	res.End = time.Now().UTC()
+	if err != nil {
+		res.Status = scriptFailed
+		res.Error = err.Error()
+		var abort aborterror
+		if errors.As(err, &abort) {
+			res.Status = scriptAborted
+		}
+	}
+	out.result(res)
+	return res
+}
+
+// steps will execute steps of script till end, fail or error.
+func (run *scriptrun) steps(ctx context.Context, sc *script) error {
+	labels := make(map[string]int)
+	for index, st := range sc.Steps {
+		if st.Label != "" {
+			labels[st.Label] = index
+		}
+	}
+	pc := 0
+	for count := 0; pc < len(sc.Steps); count++ {
+		if count >= maxscriptsteps {
+			return fmt.Errorf("more than %d steps run, script is looping", maxscriptsteps)
+		}
+		st := sc.Steps[pc]
+		next := pc + 1
+		switch {
+		case st.Label != "":
+		case st.Send != "":
+			data := run.expand(st.Send, false)
+			run.out.step("step %d: send %s", pc, strconv.Quote(data))
+			if err := run.send([]byte(data)); err != nil {
+				return fmt.Errorf("step %d: %w", pc, err)
+			}
+		case st.Expect != "" || len(st.Cases) > 0:
+			cases := st.Cases
+			if st.Expect != "" {
+				cases = []scriptcase{{Regex: st.Expect, Capture: st.Capture}}
+			}
+			timeout := time.Duration(st.Timeout)
+			if timeout == 0 {
+				timeout = defaultExpectTimeout
+			}
+			res, err := run.expect(ctx, pc, cases, timeout)
+			if err == errscripttimeout && st.Ontimeout != "" {
+				next = labels[st.Ontimeout]
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("step %d: %w", pc, err)
+			}
+			if cases[res].Goto != "" {
+				next = labels[cases[res].Goto]
+			}
+		case st.Sleep > 0:
+			run.out.step("step %d: sleep %s", pc, time.Duration(st.Sleep))
+			if _, _, err := run.wait(ctx, nil, time.Duration(st.Sleep)); err != errscripttimeout {
+				return fmt.Errorf("step %d: %w", pc, err)
+			}
+		case st.Goto != "":
+			next = labels[st.Goto]
+		case st.Fail != "":
+			return errors.New(run.expand(st.Fail, false))
+		}
+		pc = next
+	}
+	return nil
+}
+
+// expand will replace ${name} with value of variable, quoted for regex if
+// quote is set. Unknown variable is replaced by empty string.
+func (run *scriptrun) expand(s string, quote bool) string {
+	return scriptvar.ReplaceAllStringFunc(s, func(ref string) string {
+		v := run.vars[ref[2:len(ref)-1]]
+		if quote {
+			return regexp.QuoteMeta(v)
+		}
+		return v
+	})
+}
+
+// send will write data to port if session still holds write role.
+func (run *scriptrun) send(data []byte) error {
+	if !run.sp.clientactive.iswriter(run.s) {
+		return aborterror{"write role was taken over"}
+	}
+	p := run.sp.getport()
+	if p == nil {
+		return aborterror{"port is closed"}
+	}
+	n, err := p.Write(data)
+	run.sp.stats.add(&run.sp.stats.writtenbytes, n)
+	if err != nil {
+		run.sp.stats.add(&run.sp.stats.writeerrors, 1)
+		return err
+	}
+	run.sp.capture.input(run.s.who(), data, time.Now())
+	return nil
+}
+
+// expect will wait for first of cases to match output and return its
+// index, output up to end of match is consumed.
+func (run *scriptrun) expect(ctx context.Context, pc int, cases []scriptcase, timeout time.Duration) (int, error) {
+	res := make([]*regexp.Regexp, len(cases))
+	quoted := ""
+	for index, c := range cases {
+		re, err := regexp.Compile(run.expand(c.Regex, true))
+		if err != nil {
+			return 0, err
+		}
+		res[index] = re
+		if index > 0 {
+			quoted = quoted + " | "
+		}
+		quoted = quoted + strconv.Quote(re.String())
+	}
+	run.out.step("step %d: expect %s (timeout %s)", pc, quoted, timeout)
+	index, m, err := run.wait(ctx, res, timeout)
+	if err != nil {
+		return 0, err
+	}
+	if name := cases[index].Capture; name != "" {
+		run.vars[name] = m[0]
+		if len(m) > 1 {
+			run.vars[name] = m[1]
+		}
+		run.out.step("step %d: %s = %s", pc, name, strconv.Quote(run.vars[name]))
+	}
+	return index, nil
+}
+
+// wait will read output of port till one of res matches and return its
+// index and submatches. It returns errscripttimeout on timeout, with nil
+// res it just waits for timeout.
+func (run *scriptrun) wait(ctx context.Context, res []*regexp.Regexp, timeout time.Duration) (int, []string, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		if index, m := run.match(res); index >= 0 {
+			return index, m, nil
+		}
+		select {
+		case v := <-run.sub.ch:
+			run.feed(v)
+		case <-timer.C:
+			return 0, nil, errscripttimeout
+		case reason := <-run.s.closed:
+			return 0, nil, aborterror{"session closed: " + reason}
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return 0, nil, aborterror{"script timed out"}
+			}
+			return 0, nil, aborterror{"script canceled"}
+		}
+	}
+}
+
+// match will return index of regex matching earliest in buffered output
+// and its submatches, or -1. Output up to end of match is consumed.
+func (run *scriptrun) match(res []*regexp.Regexp) (int, []string) {
+	found, start, end := -1, 0, 0
+	var m []string
+	for index, re := range res {
+		loc := re.FindSubmatchIndex(run.buf)
+		if loc == nil || (found >= 0 && loc[0] >= start) {
+			continue
+		}
+		found, start, end = index, loc[0], loc[1]
+		m = nil
+		for i := 0; i < len(loc); i = i + 2 {
+			if loc[i] >= 0 {
+				m = append(m, string(run.buf[loc[i]:loc[i+1]]))
+			} else {
+				m = append(m, "")
+			}
+		}
+	}
+	if found >= 0 {
+		run.buf = run.buf[end:]
+	}
+	return found, m
+}
+
+// feed will add output of port to expect buffer, transcript and result.
+func (run *scriptrun) feed(data []byte) {
+	run.out.output(data)
+	run.buf = append(run.buf, data...)
+	if len(run.buf) > maxexpectbuffer {
+		run.buf = run.buf[len(run.buf)-maxexpectbuffer:]
+	}
+	if len(run.res.output)+len(data) <= maxscriptoutput {
+		run.res.output = append(run.res.output, data...)
+	}
+}
+
+// runScript will run script posted as JSON on port given in path, as
+// session with write role of port. With takeover=1 role is taken from
+// current writer, otherwise call fails if someone holds it. Transcript is
+// streamed as text, or JSON lines with format=json.
+func runScript(w http.ResponseWriter, r *http.Request) {
+	sp, pname := pathport(r)
+	if sp == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Port not found."))
+		return
+	}
+	if !authorize(w, r, pname, roleOperator) {
+		return
+	}
+	var sc script
+	if err := json.NewDecoder(r.Body).Decode(&sc); err != nil {
+		log.Printf("[Client:%s Serial Port:%s]Error in posted JSON decode:%s",
+			r.RemoteAddr, pname, err)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid script: " + err.Error()))
+		return
+	}
+	var errs configerrors
+	sc.check("script", &errs)
+	if len(errs) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(errs.Error()))
+		return
+	}
+	if sc.Name == "" {
+		sc.Name = "script"
+	}
+	all.mu.Lock()
+	open := sp.status == 1 && sp.port != nil
+	all.mu.Unlock()
+	if !open {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("Port is disabled or not yet opened."))
+		return
+	}
+
+	s := sp.clientactive.attach(r.RemoteAddr, username(r), "script")
+	defer sp.clientactive.detach(s)
+	takeover := r.FormValue("takeover") == "1"
+	if !takeover && !sp.clientactive.trywrite(s) {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("Port is held by writer " + sp.clientactive.getraaddr() + ", use takeover=1 to take it."))
+		return
+	}
+	auditsession(s, pname, "session.start")
+	defer auditsession(s, pname, "session.end")
+	if takeover {
+		sp.clientactive.requestwrite(s, true)
+		auditsession(s, pname, "session.takeover")
+	}
+	sub, _ := sp.comm.subscribe()
+	defer sp.comm.unsubscribe(sub)
+
+	out := &transcript{w: w, flush: func() {}, json: r.FormValue("format") == "json"}
+	if f, ok := w.(http.Flusher); ok {
+		out.flush = f.Flush
+	}
+	w.Header().Set("Trailer", "X-Script-Status")
+	if out.json {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	log.Printf("[Client:%s Serial Port:%s]Script %s started.", r.RemoteAddr, pname, sc.Name)
+	sp.capture.marker("script "+sc.Name+" started by "+s.who(), time.Now())
+	res := runscript(r.Context(), sp, s, sub, &sc, out)
+	msg := "script " + sc.Name + " " + res.Status
+	if res.Error != "" {
+		msg = msg + ": " + res.Error
+	}
+	sp.capture.marker(msg, time.Now())
+	log.Printf("[Client:%s Serial Port:%s]Script %s ended: %s %s", r.RemoteAddr, pname,
+		sc.Name, res.Status, res.Error)
+	w.Header().Set("X-Script-Status", res.Status)
+	e := auditentry{Actor: username(r), Raddr: r.RemoteAddr, Action: "script.run", Port: pname, Result: "ok"}
+	if res.Status != scriptOk {
+		e.Result = "error: " + res.Status + " " + res.Error
+	}
+	audit(e)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// runtestscript will run script given as YAML against output chunks and
+// return its result and text transcript.
+func runtestscript(t *testing.T, spec string, output ...string) (scriptresult, string) {
+	t.Helper()
+	var sc script
+	if err := yaml.Unmarshal([]byte(spec), &sc); err != nil {
+		t.Fatal(err)
+	}
+	var errs configerrors
+	sc.check("script", &errs)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	sp := &serialport{name: "/dev/ttyTEST0"}
+	s := sp.clientactive.attach("test", "alice", "script")
+	sub := &subscriber{ch: make(chan []byte, len(output))}
+	for _, o := range output {
+		sub.ch <- []byte(o)
+	}
+	var buf bytes.Buffer
+	res := runscript(context.Background(), sp, s, sub, &sc, &transcript{w: &buf, flush: func() {}})
+	return res, buf.String()
+}
+
+func TestScriptExpectAndCapture(t *testing.T) {
+	res, out := runtestscript(t, `
+vars: {host: r1.lab}
+steps:
+  - expect: '${host} login:'
+    timeout: 1s
+  - expect: 'version (\S+)'
+    capture: version
+  - cases:
+      - regex: 'error'
+        goto: bad
+      - regex: '#'
+  - goto: end
+  - label: bad
+  - fail: 'failed on ${version}'
+  - label: end
+`, "r1.lab lo", "gin: \nrouter# show", " version 1.2.3\n", "ok\nrouter# ")
+	if res.Status != scriptOk || res.Vars["version"] != "1.2.3" || res.Vars["host"] != "r1.lab" {
+		t.Errorf("result = %+v", res)
+	}
+	if !strings.Contains(out, "### step 1: version = \"1.2.3\"\n") || !strings.HasSuffix(out, "### result: ok\n") {
+		t.Errorf("transcript = %q", out)
+	}
+	if want := "r1.lab login: \nrouter# show version 1.2.3\nok\nrouter# "; string(res.output) != want {
+		t.Errorf("output = %q, want %q", res.output, want)
+	}
+}
+
+func TestScriptCasesEarliestMatch(t *testing.T) {
+	res, _ := runtestscript(t, `
+steps:
+  - cases:
+      - regex: 'router#'
+      - regex: 'error: (\w+)'
+        goto: bad
+        capture: reason
+  - fail: 'prompt first'
+  - label: bad
+  - fail: 'error ${reason}'
+`, "error: denied\nrouter# ")
+	if res.Status != scriptFailed || res.Error != "error denied" {
+		t.Errorf("result = %s %q", res.Status, res.Error)
+	}
+}
+
+func TestScriptVariableIsQuoted(t *testing.T) {
+	res, _ := runtestscript(t, `
+vars: {prompt: 'a.b'}
+steps:
+  - expect: '${prompt}'
+    timeout: 20ms
+`, "axb")
+	if res.Status != scriptFailed || !strings.Contains(res.Error, "expect timed out") {
+		t.Errorf("variable matched as regex: %s %q", res.Status, res.Error)
+	}
+}
+
+func TestScriptOntimeout(t *testing.T) {
+	start := time.Now()
+	res, _ := runtestscript(t, `
+steps:
+  - expect: 'never'
+    timeout: 20ms
+    ontimeout: retry
+  - fail: 'matched'
+  - label: retry
+  - expect: 'later'
+`, "later")
+	if res.Status != scriptOk {
+		t.Errorf("result = %s %q", res.Status, res.Error)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("ontimeout took %s", time.Since(start))
+	}
+}
+
+func TestScriptLooping(t *testing.T) {
+	res, _ := runtestscript(t, `
+steps:
+  - label: top
+  - goto: top
+`)
+	if res.Status != scriptFailed || !strings.Contains(res.Error, "looping") {
+		t.Errorf("result = %s %q", res.Status, res.Error)
+	}
+}
+
+func TestScriptAborted(t *testing.T) {
+	// Port of test is not open.
+	res, _ := runtestscript(t, `
+steps:
+  - send: "show version\r"
+`)
+	if res.Status != scriptAborted {
+		t.Errorf("send on closed port: %s %q", res.Status, res.Error)
+	}
+	res, _ = runtestscript(t, `
+timeout: 20ms
+steps:
+  - expect: never
+`)
+	if res.Status != scriptAborted || !strings.HasSuffix(res.Error, "script timed out") {
+		t.Errorf("script timeout: %s %q", res.Status, res.Error)
+	}
+}
+
+func TestScriptCheck(t *testing.T) {
+	var sc script
+	if err := yaml.Unmarshal([]byte(`
+timeout: -1s
+steps:
+  - label: a
+  - label: a
+  - send: x
+    expect: y
+  - expect: '('
+  - cases:
+      - regex: ''
+        goto: nowhere
+  - goto: b
+  - sleep: 1s
+    ontimeout: c
+`), &sc); err != nil {
+		t.Fatal(err)
+	}
+	var errs configerrors
+	sc.check("s", &errs)
+	want := []string{"s.timeout:", "s.steps[1].label:", "s.steps[2]:", "s.steps[3].expect:",
+		"s.steps[4].cases[0].regex:", "s.steps[4].cases[0].goto:", "s.steps[5].goto:", "s.steps[6].ontimeout:"}
+	if len(errs) != len(want) {
+		t.Fatalf("errors = %q", []string(errs))
+	}
+	for index, prefix := range want {
+		if !strings.HasPrefix(errs[index], prefix) {
+			t.Errorf("error %q, want %s", errs[index], prefix)
+		}
+	}
+}
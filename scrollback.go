@@ -0,0 +1,46 @@
+package main
+
+// ringbuffer keeps last n bytes written to it, older bytes are overwritten.
+type ringbuffer struct {
+	buf   []byte
+	start int
+	size  int
+}
+
+func newringbuffer(n int) *ringbuffer {
+	return &ringbuffer{buf: make([]byte, n)}
+}
+
+// write will append data to buffer, overwriting oldest bytes if buffer is full.
+func (r *ringbuffer) write(data []byte) {
+	n := len(r.buf)
+	if n == 0 {
+		return
+	}
+	if len(data) >= n {
+		copy(r.buf, data[len(data)-n:])
+		r.start = 0
+		r.size = n
+		return
+	}
+	end := (r.start + r.size) % n
+	c := copy(r.buf[end:], data)
+	copy(r.buf, data[c:])
+	r.size = r.size + len(data)
+	if r.size > n {
+		r.start = (r.start + r.size - n) % n
+		r.size = n
+	}
+}
+
+// bytes will return copy of buffered data from oldest to newest.
+func (r *ringbuffer) bytes() []byte {
+	out := make([]byte, r.size)
+	end := r.start + r.size
+	if end > len(r.buf) {
+		end = len(r.buf)
+	}
+	c := copy(out, r.buf[r.start:end])
+	copy(out[c:], r.buf[:r.size-c])
+	return out
+}
@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+func TestRingbufferWraps(t *testing.T) {
+	r := newringbuffer(8)
+	if got := r.bytes(); len(got) != 0 {
+		t.Fatalf("empty buffer has %q", got)
+	}
+	steps := []struct{ write, want string }{
+		{"abc", "abc"},
+		{"defgh", "abcdefgh"},
+		{"ij", "cdefghij"},
+		{"klmno", "hijklmno"},
+		{"0123456789", "23456789"},
+		{"x", "3456789x"},
+	}
+	for _, step := range steps {
+		r.write([]byte(step.write))
+		if got := string(r.bytes()); got != step.want {
+			t.Fatalf("after write %q buffer = %q, want %q", step.write, got, step.want)
+		}
+	}
+}
+
+func TestRingbufferBytesIsCopy(t *testing.T) {
+	r := newringbuffer(4)
+	r.write([]byte("abcd"))
+	b := r.bytes()
+	b[0] = 'z'
+	if got := string(r.bytes()); got != "abcd" {
+		t.Errorf("buffer changed through returned bytes: %q", got)
+	}
+}
+
+func TestRingbufferZeroSize(t *testing.T) {
+	r := newringbuffer(0)
+	r.write([]byte("abc"))
+	if got := r.bytes(); len(got) != 0 {
+		t.Errorf("zero size buffer kept %q", got)
+	}
+}
+
+// intp will return pointer to n for optional config fields.
+func intp(n int) *int {
+	return &n
+}
+
+func TestScrollbacksize(t *testing.T) {
+	var pc port
+	if got := pc.scrollbacksize(); got != defaultScrollback {
+		t.Errorf("size without scrollback = %d, want default", got)
+	}
+	// Explicit 0 disables replay, it is not default.
+	pc.Scrollback = intp(0)
+	if got := pc.scrollbacksize(); got != 0 {
+		t.Errorf("size with scrollback 0 = %d", got)
+	}
+	pc.Scrollback = intp(1024)
+	if got := pc.scrollbacksize(); got != 1024 {
+		t.Errorf("size with scrollback 1024 = %d", got)
+	}
+}
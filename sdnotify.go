@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdnotify will send state like READY=1 to systemd if service runs with
+// Type=notify, it does nothing otherwise.
+func sdnotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	// Abstract socket name starts with @.
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("Error connecting to systemd notify socket: %s", err)
+		return
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(state)); err != nil {
+		log.Printf("Error notifying systemd: %s", err)
+	}
+}
+
+// reloading will return RELOADING state for systemd, Type=notify-reload
+// needs MONOTONIC_USEC of reload start with it.
+func reloading() string {
+	usec := monotonicusec()
+	if usec == 0 {
+		return "RELOADING=1"
+	}
+	return "RELOADING=1\nMONOTONIC_USEC=" + strconv.FormatInt(usec, 10)
+}
+
+// startwatchdog will ping systemd watchdog at half of WatchdogSec while
+// service is alive, so that stuck service is restarted by systemd.
+func startwatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	log.Printf("Systemd watchdog enabled, notifying every %s.", interval)
+	go func() {
+		for range time.Tick(interval) {
+			if alive() {
+				sdnotify("WATCHDOG=1")
+			} else {
+				log.Printf("Service is not responding, skipping watchdog notification.")
+			}
+		}
+	}()
+}
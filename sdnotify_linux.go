@@ -0,0 +1,18 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// monotonicusec will return CLOCK_MONOTONIC time in microseconds as systemd
+// expects in MONOTONIC_USEC, or 0 if clock can not be read.
+func monotonicusec() int64 {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return 0
+	}
+	return ts.Nano() / 1000
+}
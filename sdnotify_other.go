@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// monotonicusec will return 0 as there is no systemd on this platform.
+func monotonicusec() int64 {
+	return 0
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSdnotifyReloading(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Skip("unixgram socket not supported: ", err)
+	}
+	defer conn.Close()
+	saved, had := os.LookupEnv("NOTIFY_SOCKET")
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer func() {
+		if had {
+			os.Setenv("NOTIFY_SOCKET", saved)
+		} else {
+			os.Unsetenv("NOTIFY_SOCKET")
+		}
+	}()
+
+	sdnotify(reloading())
+	buf := make([]byte, 256)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(buf[:n]), "\n")
+	if lines[0] != "RELOADING=1" {
+		t.Errorf("state = %q, want RELOADING=1 first", buf[:n])
+	}
+	if runtime.GOOS != "linux" {
+		return
+	}
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], "MONOTONIC_USEC=") {
+		t.Fatalf("state = %q, want MONOTONIC_USEC", buf[:n])
+	}
+	usec, err := strconv.ParseInt(strings.TrimPrefix(lines[1], "MONOTONIC_USEC="), 10, 64)
+	if err != nil || usec <= 0 || usec > monotonicusec() {
+		t.Errorf("MONOTONIC_USEC = %d, %v, now %d", usec, err, monotonicusec())
+	}
+}
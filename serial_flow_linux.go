@@ -0,0 +1,43 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"go.bug.st/serial"
+	"golang.org/x/sys/unix"
+)
+
+// openserial will open serial port with given line settings.
+// go.bug.st/serial always disables RTS/CTS while opening port, so
+// hardware flow control is applied on tty termios after open.
+func openserial(name string, line lineconfig) (serial.Port, error) {
+	mode, err := line.mode()
+	if err != nil {
+		return nil, err
+	}
+	if !line.rtscts() {
+		return serial.Open(name, mode)
+	}
+	// Descriptor is opened before serial.Open takes exclusive access of
+	// tty. termios settings are shared by all descriptors of device.
+	fd, err := unix.Open(name, unix.O_RDWR|unix.O_NOCTTY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+	p, err := serial.Open(name, mode)
+	if err != nil {
+		return nil, err
+	}
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err == nil {
+		t.Cflag |= unix.CRTSCTS
+		err = unix.IoctlSetTermios(fd, unix.TCSETS, t)
+	}
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
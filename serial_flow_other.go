@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+
+	"go.bug.st/serial"
+)
+
+// openserial will open serial port with given line settings.
+// RTS/CTS flow control is only supported on linux.
+func openserial(name string, line lineconfig) (serial.Port, error) {
+	mode, err := line.mode()
+	if err != nil {
+		return nil, err
+	}
+	if line.rtscts() {
+		return nil, errors.New("rtscts flow control is not supported on this platform")
+	}
+	return serial.Open(name, mode)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"go.bug.st/serial"
+)
+
+// lineconfig struct holds serial line settings of a port as per yaml config.
+type lineconfig struct {
+	Baudrate    int    `yaml:"baudrate"`
+	Databits    int    `yaml:"databits,omitempty"`
+	Parity      string `yaml:"parity,omitempty"`
+	Stopbits    string `yaml:"stopbits,omitempty"`
+	Flowcontrol string `yaml:"flowcontrol,omitempty"`
+}
+
+// parity names accepted in config and API.
+var parities = map[string]serial.Parity{
+	"none":  serial.NoParity,
+	"odd":   serial.OddParity,
+	"even":  serial.EvenParity,
+	"mark":  serial.MarkParity,
+	"space": serial.SpaceParity,
+}
+
+// normalize will fill defaults for settings not provided, so that
+// 115200 alone is same as 115200 8N1 without flow control.
+func (l lineconfig) normalize() lineconfig {
+	if l.Databits == 0 {
+		l.Databits = 8
+	}
+	l.Parity = strings.ToLower(strings.TrimSpace(l.Parity))
+	// "0" was the placeholder value of parity in older config files.
+	if l.Parity == "" || l.Parity == "0" {
+		l.Parity = "none"
+	}
+	l.Stopbits = strings.TrimSpace(l.Stopbits)
+	if l.Stopbits == "" {
+		l.Stopbits = "1"
+	}
+	l.Flowcontrol = strings.ToLower(strings.TrimSpace(l.Flowcontrol))
+	if l.Flowcontrol == "" {
+		l.Flowcontrol = "none"
+	}
+	return l
+}
+
+// fielderror is problem of single yaml field.
+type fielderror struct {
+	field string
+	msg   string
+}
+
+// fielderrors will return every line setting which is not supported.
+func (l lineconfig) fielderrors() []fielderror {
+	l = l.normalize()
+	var errs []fielderror
+	if l.Baudrate <= 0 {
+		errs = append(errs, fielderror{"baudrate", "baudrate must be greater than 0"})
+	}
+	if l.Databits < 5 || l.Databits > 8 {
+		errs = append(errs, fielderror{"databits", "databits must be 5, 6, 7 or 8"})
+	}
+	if _, got := parities[l.Parity]; !got {
+		errs = append(errs, fielderror{"parity", "parity must be none, odd, even, mark or space"})
+	}
+	if _, got := stopbits[l.Stopbits]; !got {
+		errs = append(errs, fielderror{"stopbits", "stopbits must be " + stopbitsnames})
+	}
+	if l.Flowcontrol != "none" && l.Flowcontrol != "rtscts" {
+		errs = append(errs, fielderror{"flowcontrol", "flowcontrol must be none or rtscts"})
+	}
+	return errs
+}
+
+// validate will return error if any of line settings is not supported.
+func (l lineconfig) validate() error {
+	if errs := l.fielderrors(); len(errs) > 0 {
+		return errors.New(errs[0].msg)
+	}
+	return nil
+}
+
+// mode will return serial mode for line settings or error if
+// settings are not valid.
+func (l lineconfig) mode() (*serial.Mode, error) {
+	if err := l.validate(); err != nil {
+		return nil, err
+	}
+	l = l.normalize()
+	return &serial.Mode{
+		BaudRate: l.Baudrate,
+		DataBits: l.Databits,
+		Parity:   parities[l.Parity],
+		StopBits: stopbits[l.Stopbits],
+	}, nil
+}
+
+// rtscts will return true if hardware flow control is configured.
+func (l lineconfig) rtscts() bool {
+	return l.normalize().Flowcontrol == "rtscts"
+}
+
+// summary will return line settings in short form e.g. 115200 8N1.
+func (l lineconfig) summary() string {
+	l = l.normalize()
+	s := strconv.Itoa(l.Baudrate) + " " + strconv.Itoa(l.Databits) +
+		strings.ToUpper(l.Parity[:1]) + l.Stopbits
+	if l.rtscts() {
+		s = s + " rtscts"
+	}
+	return s
+}
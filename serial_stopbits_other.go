@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "go.bug.st/serial"
+
+// stop bits accepted in config and API. 1.5 is only supported by serial
+// driver on windows, unix ports fail to open with it.
+var stopbits = map[string]serial.StopBits{
+	"1": serial.OneStopBit,
+	"2": serial.TwoStopBits,
+}
+
+// stopbitsnames lists stop bits accepted on this platform for errors.
+const stopbitsnames = "1 or 2"
@@ -0,0 +1,16 @@
+//go:build windows
+// +build windows
+
+package main
+
+import "go.bug.st/serial"
+
+// stop bits accepted in config and API.
+var stopbits = map[string]serial.StopBits{
+	"1":   serial.OneStopBit,
+	"1.5": serial.OnePointFiveStopBits,
+	"2":   serial.TwoStopBits,
+}
+
+// stopbitsnames lists stop bits accepted on this platform for errors.
+const stopbitsnames = "1, 1.5 or 2"
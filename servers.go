@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// servers keeps running http servers and tcp listeners by their config, so
+// that they can be stopped on config reload and on shutdown.
+var servers = struct {
+	mu sync.Mutex
+	// handler serves http and https servers.
+	handler http.Handler
+	http    map[server]*http.Server
+	tcp     map[server]net.Listener
+	closing bool
+}{http: make(map[server]*http.Server), tcp: make(map[server]net.Listener)}
+
+// addhttpserver will register http server for shutdown.
+func addhttpserver(value server, srv *http.Server) {
+	servers.mu.Lock()
+	defer servers.mu.Unlock()
+	servers.http[value] = srv
+}
+
+// removehttpserver will unregister http server which stopped serving.
+func removehttpserver(value server, srv *http.Server) {
+	servers.mu.Lock()
+	defer servers.mu.Unlock()
+	if servers.http[value] == srv {
+		delete(servers.http, value)
+	}
+}
+
+// addtcplistener will register tcp listener for shutdown.
+func addtcplistener(value server, ln net.Listener) {
+	servers.mu.Lock()
+	defer servers.mu.Unlock()
+	servers.tcp[value] = ln
+}
+
+// removetcplistener will unregister tcp listener which stopped serving.
+func removetcplistener(value server, ln net.Listener) {
+	servers.mu.Lock()
+	defer servers.mu.Unlock()
+	if servers.tcp[value] == ln {
+		delete(servers.tcp, value)
+	}
+}
+
+// shuttingdown will return true once shutdown started, listener errors
+// after it are expected.
+func shuttingdown() bool {
+	servers.mu.Lock()
+	defer servers.mu.Unlock()
+	return servers.closing
+}
+
+// tcpstopped will return true if given listener was closed on purpose by
+// shutdown or config reload.
+func tcpstopped(value server, ln net.Listener) bool {
+	servers.mu.Lock()
+	defer servers.mu.Unlock()
+	return servers.closing || servers.tcp[value] != ln
+}
+
+// startserver will start listener of given server config. It returns once
+// listener is bound, serving runs in go routine. Listener errors are sent
+// to errs, or only logged if errs is nil.
+func startserver(value server, errs chan<- error) {
+	if value.Enable != 1 {
+		log.Printf("Server disabled for protocol:%s", value.Name)
+		return
+	}
+	fail := func(err error) {
+		if errs != nil {
+			errs <- err
+		}
+	}
+	switch value.Name {
+	case "http", "https":
+		log.Printf("%s server starting", value.Name)
+		srv := &http.Server{Addr: ":" + strconv.Itoa(value.Port), Handler: servers.handler}
+		// Listening first tells readiness that server is up.
+		ln, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			log.Printf("net.%s could not listen: %s", value.Name, err)
+			fail(err)
+			return
+		}
+		addhttpserver(value, srv)
+		go func() {
+			var err error
+			if value.Name == "https" {
+				err = srv.ServeTLS(ln, value.SslCert, value.SslKey)
+			} else {
+				err = srv.Serve(ln)
+			}
+			removehttpserver(value, srv)
+			if err != nil && err != http.ErrServerClosed {
+				log.Printf("net.%s could not serve: %s", value.Name, err)
+				fail(err)
+			}
+		}()
+	case "tcp":
+		log.Printf("tcp %s server starting for port:%s", value.Mode, value.Serialport)
+		if authenabled() && value.User != "" && !loopback(value.Bind) {
+			err := fmt.Errorf("tcp server on port %d skips token prompt for user %s, with auth enabled it must bind to loopback", value.Port, value.User)
+			log.Printf("net.tcp not started: %s", err)
+			fail(err)
+			return
+		}
+		ln, err := listentcp(value)
+		if err != nil {
+			log.Printf("net.tcp could not listen: %s", err)
+			fail(err)
+			return
+		}
+		go func() {
+			if err := accepttcp(value, ln); err != nil {
+				log.Printf("net.tcp could not accept: %s", err)
+				fail(err)
+			}
+		}()
+	default:
+		log.Printf("Unknown protocol %s... Skipping...", value.Name)
+	}
+}
+
+// stopserver will stop listener of given server config. Running http
+// requests get stop timeout to finish, console sessions are kept.
+func stopserver(value server) {
+	servers.mu.Lock()
+	srv := servers.http[value]
+	ln := servers.tcp[value]
+	delete(servers.http, value)
+	delete(servers.tcp, value)
+	servers.mu.Unlock()
+	if srv != nil {
+		log.Printf("%s server on port %d stopping", value.Name, value.Port)
+		ctx, cancel := context.WithTimeout(context.Background(), config.stoptimeout())
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Error shutting down server %s: %s", srv.Addr, err)
+		}
+	}
+	if ln != nil {
+		log.Printf("tcp server on port %d for port:%s stopping", value.Port, value.Serialport)
+		ln.Close()
+	}
+}
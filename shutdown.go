@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// default timeout of graceful shutdown.
+const defaultShutdownTimeout = 10 * time.Second
+
+// shutdowntimeout will return configured shutdown timeout or default.
+func (config *Config) shutdowntimeout() time.Duration {
+	config.mu.Lock()
+	defer config.mu.Unlock()
+	if config.Timeouts.Shutdown <= 0 {
+		return defaultShutdownTimeout
+	}
+	return config.Timeouts.Shutdown
+}
+
+// shutdown will stop service gracefully within configured timeout. New
+// connections are refused first, then console sessions get close frame with
+// reason, readers are stopped and logs are flushed and closed.
+func shutdown(reason string) {
+	timeout := config.shutdowntimeout()
+	log.Printf("Shutting down: %s. Timeout %s.", reason, timeout)
+	sdnotify("STOPPING=1")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	servers.mu.Lock()
+	servers.closing = true
+	var httpservers []*http.Server
+	for _, srv := range servers.http {
+		httpservers = append(httpservers, srv)
+	}
+	for _, ln := range servers.tcp {
+		ln.Close()
+	}
+	servers.mu.Unlock()
+
+	// Shutdown closes listeners at once and waits for running requests,
+	// websocket connections are hijacked so they are closed below.
+	var wg sync.WaitGroup
+	for _, srv := range httpservers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("Error shutting down server %s: %s", srv.Addr, err)
+			}
+		}(srv)
+	}
+
+	all.mu.Lock()
+	var ports []*serialport
+	for _, sp := range all.ports {
+		ports = append(ports, sp)
+	}
+	all.mu.Unlock()
+
+	stopjobs()
+	for _, sp := range ports {
+		sp.clientactive.closeall("Server shutting down: " + reason)
+	}
+	for _, sp := range ports {
+		for sp.clientactive.getconncount() > 0 && ctx.Err() == nil {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	for _, sp := range ports {
+		if err := sp.stopreader(); err != nil {
+			log.Printf("Error stopping reader of port:%s %s", sp.name, err)
+		}
+		sp.closelog()
+	}
+	wg.Wait()
+	closeaudit()
+	log.Printf("Shutdown complete.")
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// parity names as per RFC 2217 SET-PARITY values.
+var rfc2217parity = []string{"", "none", "odd", "even", "mark", "space"}
+
+// stop bits as per RFC 2217 SET-STOPSIZE values.
+var rfc2217stopbits = []string{"", "1", "2", "1.5"}
+
+// tcp client must send token within tcplogintimeout, token line is at most
+// tcptokenmax bytes.
+const (
+	tcplogintimeout = 30 * time.Second
+	tcptokenmax     = 256
+)
+
+// tcpconsole is single raw or RFC 2217 client of a serial port.
+type tcpconsole struct {
+	wmu  sync.Mutex
+	conn net.Conn
+	sp   *serialport
+	s    *session
+	tn   *telnet
+	// line settings applied on open port by this client.
+	line lineconfig
+	dtr  bool
+	rts  bool
+}
+
+// listentcp will bind tcp listener of given server config.
+func listentcp(value server) (net.Listener, error) {
+	ln, err := net.Listen("tcp", net.JoinHostPort(value.Bind, strconv.Itoa(value.Port)))
+	if err != nil {
+		return nil, err
+	}
+	addtcplistener(value, ln)
+	return ln, nil
+}
+
+// accepttcp will serve console of given serial port on tcp port in raw or
+// rfc2217 mode. It returns only if listener fails or is stopped by shutdown
+// or config reload.
+func accepttcp(value server, ln net.Listener) error {
+	defer ln.Close()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if tcpstopped(value, ln) {
+				return nil
+			}
+			removetcplistener(value, ln)
+			return err
+		}
+		go servetcp(conn, value)
+	}
+}
+
+// loopback will return true if tcp listener bind address is reachable only
+// from this host. Listener with user given does not ask for token, so with
+// auth enabled it may only listen on loopback.
+func loopback(bind string) bool {
+	if bind == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(bind)
+	return ip != nil && ip.IsLoopback()
+}
+
+// servetcp will attach tcp client to serial port with same session
+// accounting as websocket clients. First client with operator role gets
+// write role.
+func servetcp(conn net.Conn, value server) {
+	var raddr = conn.RemoteAddr().String()
+	pname, mode := value.Serialport, value.Mode
+	defer func() {
+		conn.Close()
+		log.Printf("[Client:%s Serial Port:%s]Closed tcp session.", raddr, pname)
+	}()
+	log.Printf("[Client:%s Serial Port:%s]Starting %s tcp session", raddr, pname, mode)
+	all.mu.Lock()
+	sp, got := all.ports[pname]
+	if !got || sp.status != 1 || sp.port == nil {
+		all.mu.Unlock()
+		log.Printf("[Client:%s Serial Port:%s]Port is disabled or not yet opened.", raddr, pname)
+		conn.Write([]byte("Port is disabled or not yet opened. Please try again.\r\n"))
+		return
+	}
+	all.mu.Unlock()
+
+	c := &tcpconsole{conn: conn, sp: sp, line: sp.line, dtr: true, rts: true}
+	user, role := c.login(value)
+	if role < roleViewer {
+		log.Printf("[Client:%s Serial Port:%s]User %s not allowed for tcp console.", raddr, pname, user)
+		conn.Write([]byte("Not allowed.\r\n"))
+		return
+	}
+	c.s = sp.clientactive.attach(raddr, user, "tcp")
+	auditsession(c.s, pname, "session.start")
+	defer func() {
+		sp.clientactive.detach(c.s)
+		sp.capture.endinput(c.s.who())
+		auditsession(c.s, pname, "session.end")
+	}()
+	// Line settings changed by client are valid till session ends.
+	defer func() {
+		if c.line != sp.line {
+			c.setline(sp.line)
+		}
+	}()
+	if role >= roleOperator {
+		sp.clientactive.trywrite(c.s)
+	}
+	sub, _ := sp.comm.subscribe()
+	defer sp.comm.unsubscribe(sub)
+	if mode == "rfc2217" {
+		c.tn = newtelnet(func(b []byte) { c.write(b) }, c.comport)
+		c.tn.start()
+	}
+
+	// goroutine to read from port and write to tcp client
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		for {
+			select {
+			case v := <-sub.ch:
+				if c.tn != nil {
+					v = telnetescape(v)
+				}
+				if err := c.write(v); err != nil {
+					sp.stats.add(&sp.stats.tcperrors, 1)
+					log.Printf("[Client:%s Serial Port:%s]Write error %s", raddr, pname, err)
+					conn.Close()
+					return
+				}
+			case reason := <-c.s.closed:
+				log.Printf("[Client:%s Serial Port:%s]Closing tcp session: %s", raddr, pname, reason)
+				c.write([]byte("\r\n" + reason + "\r\n"))
+				conn.Close()
+				return
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			log.Printf("[Client:%s Serial Port:%s]Error reading: %s.", raddr, pname, err)
+			return
+		}
+		data := buf[:n]
+		if c.tn != nil {
+			data = c.tn.parse(data)
+		}
+		if len(data) == 0 || !sp.clientactive.iswriter(c.s) {
+			continue
+		}
+		p := sp.getport()
+		if p == nil {
+			log.Printf("[Client:%s Serial Port:%s]Port is closed.", raddr, pname)
+			return
+		}
+		n, err = p.Write(data)
+		sp.stats.add(&sp.stats.writtenbytes, n)
+		if err != nil {
+			sp.stats.add(&sp.stats.writeerrors, 1)
+			log.Printf("[Client:%s Serial Port:%s]Error writing to port: %s.", raddr, pname, err)
+			return
+		}
+		sp.capture.input(c.s.who(), data, time.Now())
+	}
+}
+
+// login will return user and role of tcp client on port. Without auth
+// every client is admin attributed to user of listener, or tcp if none is
+// given. With auth, user of listener is trusted if given, otherwise client
+// is asked for bearer token.
+func (c *tcpconsole) login(value server) (string, int) {
+	config.mu.Lock()
+	a := config.Auth
+	config.mu.Unlock()
+	if a.Enable != 1 {
+		if value.User == "" {
+			return "tcp", roleAdmin
+		}
+		return value.User, roleAdmin
+	}
+	var u *authuser
+	if value.User != "" {
+		u = a.finduser(value.User)
+	} else if token, err := c.readtoken(value.Mode == "rfc2217"); err != nil {
+		log.Printf("[Client:%s Serial Port:%s]Error reading token: %s.", c.conn.RemoteAddr(), c.sp.name, err)
+	} else {
+		u = a.tokenuser(token)
+	}
+	if u == nil {
+		return "", roleNone
+	}
+	return u.name, u.role(c.sp.name)
+}
+
+// readtoken will prompt tcp client for token and return first line it
+// sends. Telnet commands of rfc2217 client are dropped, options are
+// negotiated after login.
+func (c *tcpconsole) readtoken(telnetmode bool) (string, error) {
+	var tn *telnet
+	if telnetmode {
+		tn = newtelnet(func([]byte) {}, func(byte, []byte) {})
+	}
+	c.conn.SetReadDeadline(time.Now().Add(tcplogintimeout))
+	defer c.conn.SetReadDeadline(time.Time{})
+	if err := c.write([]byte("Token: ")); err != nil {
+		return "", err
+	}
+	var line []byte
+	buf := make([]byte, 64)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		data := buf[:n]
+		if tn != nil {
+			data = tn.parse(data)
+		}
+		if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+			line = append(line, data[:i]...)
+			c.write([]byte("\r\n"))
+			return string(bytes.TrimSpace(line)), nil
+		}
+		line = append(line, data...)
+		if len(line) > tcptokenmax {
+			return "", errors.New("token line too long")
+		}
+	}
+}
+
+// write will send data to tcp client, it is safe for concurrent use.
+func (c *tcpconsole) write(b []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// comport will handle RFC 2217 command of client and reply with value in
+// effect. Only client holding write role can change port settings, others
+// get current value.
+func (c *tcpconsole) comport(cmd byte, data []byte) {
+	writer := c.sp.clientactive.iswriter(c.s)
+	var value byte
+	if len(data) > 0 {
+		value = data[0]
+	}
+	reply := []byte{value}
+	switch cmd {
+	case cpSignature:
+		reply = []byte("serial-port-websocket " + ver + " " + c.sp.name)
+	case cpSetBaudrate:
+		if len(data) == 4 && binary.BigEndian.Uint32(data) != 0 && writer {
+			l := c.line
+			l.Baudrate = int(binary.BigEndian.Uint32(data))
+			c.setline(l)
+		}
+		reply = make([]byte, 4)
+		binary.BigEndian.PutUint32(reply, uint32(c.line.Baudrate))
+	case cpSetDatasize:
+		if value != 0 && writer {
+			l := c.line
+			l.Databits = int(value)
+			c.setline(l)
+		}
+		reply = []byte{byte(c.line.Databits)}
+	case cpSetParity:
+		if value != 0 && int(value) < len(rfc2217parity) && writer {
+			l := c.line
+			l.Parity = rfc2217parity[value]
+			c.setline(l)
+		}
+		reply = []byte{indexof(rfc2217parity, c.line.Parity)}
+	case cpSetStopsize:
+		if value != 0 && int(value) < len(rfc2217stopbits) && writer {
+			// Stop bits not supported on this platform are refused,
+			// reply tells client current value.
+			if _, got := stopbits[rfc2217stopbits[value]]; got {
+				l := c.line
+				l.Stopbits = rfc2217stopbits[value]
+				c.setline(l)
+			} else {
+				log.Printf("[Client:%s Serial Port:%s]Stop bits %s not supported, refused.",
+					c.s.raddr, c.sp.name, rfc2217stopbits[value])
+			}
+		}
+		reply = []byte{indexof(rfc2217stopbits, c.line.Stopbits)}
+	case cpSetControl:
+		reply = []byte{c.control(value, writer)}
+	case cpSetLinestateMask, cpSetModemstateMask:
+	case cpPurgeData:
+		if p := c.sp.getport(); p != nil && writer {
+			if value == 1 || value == 3 {
+				p.ResetInputBuffer()
+			}
+			if value == 2 || value == 3 {
+				p.ResetOutputBuffer()
+			}
+		}
+	default:
+		// Notifications and flow control suspend/resume need no reply.
+		return
+	}
+	c.write(subnegotiation(cmd+cpServerOffset, reply))
+}
+
+// control will handle SET-CONTROL command and return value in effect.
+func (c *tcpconsole) control(value byte, writer bool) byte {
+	p := c.sp.getport()
+	switch {
+	case value <= 3:
+		// Flow control can not be changed on open port, config decides it.
+		if c.line.rtscts() {
+			return 3
+		}
+		return 1
+	case value <= 6:
+		// Break is not supported.
+		return 6
+	case value <= 9:
+		if value != 7 && writer && p != nil {
+			if err := p.SetDTR(value == 8); err == nil {
+				c.dtr = value == 8
+			}
+		}
+		if c.dtr {
+			return 8
+		}
+		return 9
+	case value <= 12:
+		if value != 10 && writer && p != nil {
+			if err := p.SetRTS(value == 11); err == nil {
+				c.rts = value == 11
+			}
+		}
+		if c.rts {
+			return 11
+		}
+		return 12
+	}
+	// Inbound flow control is always none.
+	return 14
+}
+
+// setline will apply line settings on open port.
+func (c *tcpconsole) setline(l lineconfig) {
+	mode, err := l.mode()
+	if err == nil {
+		if p := c.sp.getport(); p != nil {
+			err = p.SetMode(mode)
+		}
+	}
+	if err != nil {
+		log.Printf("[Client:%s Serial Port:%s]Error setting line %s: %s",
+			c.s.raddr, c.sp.name, l.summary(), err)
+		return
+	}
+	c.line = l.normalize()
+	log.Printf("[Client:%s Serial Port:%s]Line settings changed to %s",
+		c.s.raddr, c.sp.name, c.line.summary())
+}
+
+// indexof will return index of value in list or 0.
+func indexof(list []string, value string) byte {
+	for index := range list {
+		if list[index] == value {
+			return byte(index)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// tcplogin will run login of tcp console with client sending given bytes
+// after prompt, and return result and everything client received.
+func tcplogin(t *testing.T, value server, send []byte) (string, int, string) {
+	server, client := net.Pipe()
+	received := make(chan string)
+	go func() {
+		prompt := make([]byte, len("Token: "))
+		if value.User == "" && authenabled() {
+			if _, err := client.Read(prompt); err != nil {
+				t.Error(err)
+			}
+			client.Write(send)
+		}
+		rest, _ := ioutil.ReadAll(client)
+		received <- string(prompt) + string(rest)
+	}()
+	c := &tcpconsole{conn: server, sp: &serialport{name: "/dev/ttyUSB0"}}
+	user, role := c.login(value)
+	server.Close()
+	return user, role, <-received
+}
+
+func TestTcpLogin(t *testing.T) {
+	sum := sha256.Sum256([]byte("tok3n"))
+	var a authconfig
+	if err := yaml.Unmarshal([]byte(`
+enable: 1
+users:
+  - name: lab
+    roles: {"*": viewer, /dev/ttyUSB0: operator}
+  - name: ci
+    roles: {"*": viewer}
+tokens:
+  - name: lab
+    user: lab
+    sha256: `+hex.EncodeToString(sum[:])), &a); err != nil {
+		t.Fatal(err)
+	}
+	config.mu.Lock()
+	saved := config.Auth
+	config.mu.Unlock()
+	defer func() {
+		config.mu.Lock()
+		config.Auth = saved
+		config.mu.Unlock()
+	}()
+
+	config.mu.Lock()
+	config.Auth = authconfig{Enable: 2}
+	config.mu.Unlock()
+	if user, role, _ := tcplogin(t, server{Mode: "raw"}, nil); user != "tcp" || role != roleAdmin {
+		t.Errorf("without auth = %q, %d", user, role)
+	}
+	if user, _, _ := tcplogin(t, server{Mode: "raw", User: "lab"}, nil); user != "lab" {
+		t.Errorf("without auth, user of listener = %q", user)
+	}
+
+	config.mu.Lock()
+	config.Auth = a
+	config.mu.Unlock()
+	user, role, got := tcplogin(t, server{Mode: "raw"}, []byte("tok3n\r\n"))
+	if user != "lab" || role != roleOperator || got != "Token: \r\n" {
+		t.Errorf("token = %q, %d, client got %q", user, role, got)
+	}
+	if user, role, _ := tcplogin(t, server{Mode: "raw"}, []byte("guess\n")); user != "" || role != roleNone {
+		t.Errorf("wrong token = %q, %d", user, role)
+	}
+	// Telnet negotiation of rfc2217 client before token is dropped.
+	send := append([]byte{telnetIAC, telnetWILL, optBinary}, "tok3n\r\x00"...)
+	if user, _, _ := tcplogin(t, server{Mode: "rfc2217"}, send); user != "lab" {
+		t.Errorf("token after telnet negotiation = %q", user)
+	}
+	if user, role, _ := tcplogin(t, server{Mode: "raw", User: "ci"}, nil); user != "ci" || role != roleViewer {
+		t.Errorf("user of listener = %q, %d", user, role)
+	}
+}
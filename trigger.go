@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trigger action types.
+const (
+	actionWebhook = "webhook"
+	actionCommand = "command"
+	actionMarker  = "marker"
+)
+
+// default and maximum number of context lines sent with trigger event.
+const (
+	defaultTriggerContext = 5
+	maxTriggerContext     = 100
+)
+
+// actiontimeout bounds webhook request and command run time.
+const actiontimeout = 30 * time.Second
+
+// trigger struct as per yaml config, rule matched on output of port.
+type trigger struct {
+	Name  string `yaml:"name" json:"name"`
+	Regex string `yaml:"regex" json:"regex"`
+	// Cooldown is minimum time between two firings of trigger.
+	Cooldown time.Duration `yaml:"cooldown,omitempty" json:"cooldown,omitempty"`
+	// Context is number of output lines before match sent with event.
+	Context int             `yaml:"context,omitempty" json:"context,omitempty"`
+	Actions []triggeraction `yaml:"actions" json:"actions"`
+}
+
+// triggeraction struct as per yaml config. Webhook posts event as JSON to
+// URL, command runs argv with event on stdin and marker writes text into
+// log of port.
+type triggeraction struct {
+	Type    string   `yaml:"type" json:"type"`
+	URL     string   `yaml:"url,omitempty" json:"url,omitempty"`
+	Command []string `yaml:"command,omitempty" json:"command,omitempty"`
+	Text    string   `yaml:"text,omitempty" json:"text,omitempty"`
+}
+
+// triggerevent is sent to webhook and command when trigger fires.
+type triggerevent struct {
+	Port    string    `json:"port"`
+	Trigger string    `json:"trigger"`
+	Time    time.Time `json:"time"`
+	Match   string    `json:"match"`
+	Line    string    `json:"line"`
+	Context []string  `json:"context"`
+}
+
+// check will add problems of trigger at given path to errs.
+func (tr *trigger) check(path string, errs *configerrors) {
+	if tr.Name == "" {
+		errs.add(path+".name", "must not be empty")
+	}
+	if tr.Regex == "" {
+		errs.add(path+".regex", "must not be empty")
+	} else if _, err := regexp.Compile(tr.Regex); err != nil {
+		errs.add(path+".regex", "%s", err)
+	}
+	if tr.Cooldown < 0 {
+		errs.add(path+".cooldown", "must not be negative")
+	}
+	if tr.Context < 0 || tr.Context > maxTriggerContext {
+		errs.add(path+".context", "must be between 0 and %d", maxTriggerContext)
+	}
+	if len(tr.Actions) == 0 {
+		errs.add(path+".actions", "at least one action is needed")
+	}
+	for index, a := range tr.Actions {
+		apath := fmt.Sprintf("%s.actions[%d]", path, index)
+		switch a.Type {
+		case actionWebhook:
+			if u, err := url.Parse(a.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs.add(apath+".url", "must be http or https URL")
+			}
+		case actionCommand:
+			if len(a.Command) == 0 || a.Command[0] == "" {
+				errs.add(apath+".command", "must not be empty")
+			}
+		case actionMarker:
+		default:
+			errs.add(apath+".type", "must be webhook, command or marker")
+		}
+	}
+}
+
+// triggerrule is compiled trigger with its firing state.
+type triggerrule struct {
+	trigger
+	re   *regexp.Regexp
+	last time.Time
+	// firedline is number of line rule fired on, rule fires once per line
+	// even if it matched on partial line already.
+	firedline uint64
+	fired     bool
+	// busy tells webhook or command of earlier event is still running.
+	busy bool
+}
+
+// triggerset will match rules on output lines of port. Rules are checked
+// on partial line too, so prompts like login: without newline are found.
+type triggerset struct {
+	mu     sync.Mutex
+	port   string
+	rules  []*triggerrule
+	line   []byte
+	lineno uint64
+	// history keeps last complete lines for context of event.
+	history []string
+	context int
+}
+
+// newtriggerset will compile given triggers of port, config is validated
+// already so invalid regex is skipped.
+func newtriggerset(pn string, triggers []trigger) *triggerset {
+	ts := &triggerset{port: pn}
+	ts.set(triggers)
+	return ts
+}
+
+// set will replace rules, used on config reload. Firing state of rules
+// with same name is kept so cooldown still applies.
+func (ts *triggerset) set(triggers []trigger) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	old := make(map[string]*triggerrule)
+	for _, r := range ts.rules {
+		old[r.Name] = r
+	}
+	ts.rules = nil
+	ts.context = 0
+	for _, tr := range triggers {
+		re, err := regexp.Compile(tr.Regex)
+		if err != nil {
+			log.Printf("Port:%s trigger %s: %s", ts.port, tr.Name, err)
+			continue
+		}
+		r := &triggerrule{trigger: tr, re: re}
+		if o, got := old[tr.Name]; got {
+			r.last = o.last
+		}
+		if r.Context == 0 {
+			r.Context = defaultTriggerContext
+		}
+		if r.Context > ts.context {
+			ts.context = r.Context
+		}
+		ts.rules = append(ts.rules, r)
+	}
+}
+
+// scan will match rules on data read at time t and return events of rules
+// which fired.
+func (ts *triggerset) scan(data []byte, t time.Time) []triggerevent {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if len(ts.rules) == 0 {
+		return nil
+	}
+	var events []triggerevent
+	for len(data) > 0 {
+		n := bytes.IndexByte(data, '\n')
+		end := n >= 0
+		if !end {
+			n = len(data)
+		}
+		ts.line = append(ts.line, data[:n]...)
+		if end {
+			data = data[n+1:]
+		} else {
+			data = nil
+		}
+		line := strings.TrimRight(string(ts.line), "\r")
+		events = append(events, ts.match(line, t)...)
+		if end || len(ts.line) >= capturemaxline {
+			ts.history = append(ts.history, line)
+			if len(ts.history) > ts.context {
+				ts.history = ts.history[len(ts.history)-ts.context:]
+			}
+			ts.line = ts.line[:0]
+			ts.lineno = ts.lineno + 1
+		}
+	}
+	return events
+}
+
+// match will check every rule on current line. Caller must hold mu.
+func (ts *triggerset) match(line string, t time.Time) []triggerevent {
+	var events []triggerevent
+	for _, r := range ts.rules {
+		if r.fired && r.firedline == ts.lineno {
+			continue
+		}
+		loc := r.re.FindStringIndex(line)
+		if loc == nil {
+			continue
+		}
+		r.fired = true
+		r.firedline = ts.lineno
+		if !r.last.IsZero() && t.Sub(r.last) < r.Cooldown {
+			continue
+		}
+		r.last = t
+		context := ts.history
+		if len(context) > r.Context {
+			context = context[len(context)-r.Context:]
+		}
+		events = append(events, triggerevent{Port: ts.port, Trigger: r.Name, Time: t.UTC(),
+			Match: line[loc[0]:loc[1]], Line: line, Context: append(append([]string{}, context...), line)})
+	}
+	return events
+}
+
+// fire will run actions of trigger for event. Marker is written at once so
+// it follows matched output in log, webhook and command run in background
+// one event at a time per trigger, event matched while they run is not
+// sent to them.
+func (sp *serialport) fire(ev triggerevent) {
+	log.Printf("Port:%s trigger %s matched: %s", sp.name, ev.Trigger, ev.Line)
+	sp.stats.add(&sp.stats.triggers, 1)
+	var rule *triggerrule
+	sp.triggers.mu.Lock()
+	for _, r := range sp.triggers.rules {
+		if r.Name == ev.Trigger {
+			rule = r
+		}
+	}
+	if rule == nil {
+		sp.triggers.mu.Unlock()
+		return
+	}
+	actions := rule.Actions
+	background := false
+	for _, a := range actions {
+		background = background || a.Type == actionWebhook || a.Type == actionCommand
+	}
+	busy := background && rule.busy
+	if background && !busy {
+		rule.busy = true
+	}
+	sp.triggers.mu.Unlock()
+	for _, a := range actions {
+		if a.Type == actionMarker {
+			text := a.Text
+			if text == "" {
+				text = "trigger " + ev.Trigger + " matched: " + ev.Match
+			}
+			sp.capture.marker(text, ev.Time)
+		}
+	}
+	if busy {
+		log.Printf("Port:%s trigger %s actions still running, event dropped.", sp.name, ev.Trigger)
+		return
+	}
+	if !background {
+		return
+	}
+	go func() {
+		var wg sync.WaitGroup
+		for _, a := range actions {
+			switch a.Type {
+			case actionWebhook:
+				wg.Add(1)
+				go func(u string) {
+					defer wg.Done()
+					sp.webhook(u, ev)
+				}(a.URL)
+			case actionCommand:
+				wg.Add(1)
+				go func(argv []string) {
+					defer wg.Done()
+					sp.command(argv, ev)
+				}(a.Command)
+			}
+		}
+		wg.Wait()
+		sp.triggers.mu.Lock()
+		rule.busy = false
+		sp.triggers.mu.Unlock()
+	}()
+}
+
+// webhook will post event as JSON to given URL.
+func (sp *serialport) webhook(u string, ev triggerevent) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	client := http.Client{Timeout: actiontimeout}
+	resp, err := client.Post(u, "application/json", bytes.NewReader(b))
+	if err != nil {
+		sp.stats.add(&sp.stats.triggererrors, 1)
+		log.Printf("Port:%s trigger %s webhook error: %s", sp.name, ev.Trigger, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		sp.stats.add(&sp.stats.triggererrors, 1)
+		log.Printf("Port:%s trigger %s webhook returned %s", sp.name, ev.Trigger, resp.Status)
+	}
+}
+
+// command will run given argv with event JSON on stdin and port, trigger
+// and match in environment.
+func (sp *serialport) command(argv []string, ev triggerevent) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), actiontimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.Env = append(os.Environ(), "SPW_PORT="+ev.Port, "SPW_TRIGGER="+ev.Trigger,
+		"SPW_MATCH="+ev.Match, "SPW_LINE="+ev.Line)
+	cmd.Stdin = bytes.NewReader(append(b, '\n'))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		sp.stats.add(&sp.stats.triggererrors, 1)
+		log.Printf("Port:%s trigger %s command error: %s %s", sp.name, ev.Trigger, err,
+			strings.TrimSpace(string(out)))
+	}
+}